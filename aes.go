@@ -3,10 +3,9 @@ package gocrypt
 import (
 	"crypto/aes"
 	"crypto/rand"
+	"errors"
 	"hash"
 	"io"
-
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -17,29 +16,99 @@ const (
 
 const AESBlockSize = 16
 const KeySize256 = 32
+const KeySize192 = 24
 const KeySize128 = 16
 
+// DefaultSaltSize is the size of the random salt the default constructors generate for key derivation
+const DefaultSaltSize = 16
+
+var ErrInvalidSaltSize error = errors.New("invalid salt size")
+var ErrInvalidKeySize error = errors.New("invalid key size")
+
 type AES struct {
 	key []byte
+	kdf KDF
+
+	cache keyCache
 }
 
 func NewAES(key []byte) *AES {
 	return &AES{key: key}
 }
 
+/* NewAESWithKDF derives keys from the password with kdf, such as Argon2idKDF or ScryptKDF, instead of PBKDF2.
+*  The iterations and hash function given to the Custom constructors are ignored.
+ */
+func NewAESWithKDF(key []byte, kdf KDF) *AES {
+	return &AES{key: key, kdf: kdf}
+}
+
+/* NewAESFromKey uses key directly as the AES key, without any password derivation.
+*  The key must be 16, 24 or 32 bytes long, and match the key size of the constructors it is used with.
+*  Returns AES, error
+ */
+func NewAESFromKey(key []byte) (*AES, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrInvalidKeySize
+	}
+
+	return &AES{key: append([]byte{}, key...), kdf: rawKeyKDF{}}, nil
+}
+
+/* keyDerivation returns the KDF the AES was created with,
+*  or PBKDF2 with the given iterations and hash function if it was created with NewAES.
+ */
+func (a *AES) keyDerivation(keyIterations int, hashFunction func() hash.Hash) KDF {
+	if a.kdf != nil {
+		return a.kdf
+	}
+	return &PBKDF2KDF{Iterations: keyIterations, Hash: hashFunction}
+}
+
+/* deterministicKey returns the key for one-shot APIs like SealSIV, which have no stream to store a random salt in.
+*  Raw keys are returned as is, passwords are derived with a fixed salt per purpose, so the same password always gives the same key.
+*  Returns key, error
+ */
+func (a *AES) deterministicKey(purpose string, keySize int) ([]byte, error) {
+	kdf := a.keyDerivation(defaultKeyIterations, defaultHashFunction)
+	if kdf.ID() == KDFNone {
+		return append([]byte{}, a.key...), nil
+	}
+	return a.deriveKey(kdf, []byte("gocrypt "+purpose), keySize)
+}
+
 /* newAESCipher is meant to be used by internal functions.
-*  Creates a AESWriter with a populated IV and block.
+*  Creates a AESWriter with a populated IV, salt and block.
+*  The key is derived from a fresh random salt of saltSize bytes, see aes_keycache.go
 *  Returns AESWriter, error
  */
-func (a *AES) newAESWriter(keyIterations int, keySize int, hashFunction func() hash.Hash) (*AESWriter, error) {
+func (a *AES) newAESWriter(kdf KDF, keySize int, saltSize int) (*AESWriter, error) {
+
+	if saltSize < 0 {
+		return nil, ErrInvalidSaltSize
+	}
+	//A raw key is not derived, so it needs no salt
+	if kdf.ID() == KDFNone {
+		saltSize = 0
+	}
 
-	derivedKey := pbkdf2.Key(a.key, nil, keyIterations, keySize, hashFunction)
 	aw := AESWriter{
 		BlockSize: keySize,
-		key:       derivedKey,
-		IV:        make([]byte, AESBlockSize),
+		iv:        make([]byte, AESBlockSize),
+		kdf:       kdf,
+	}
+	rand.Read(aw.iv)
+	salt, err := newSalt(saltSize)
+	if err != nil {
+		return nil, err
+	}
+	aw.salt = salt
+	aw.key, err = a.deriveKey(kdf, aw.salt, keySize)
+	if err != nil {
+		return nil, err
 	}
-	rand.Read(aw.IV)
 
 	block, err := aes.NewCipher(aw.key)
 	if err != nil {
@@ -50,16 +119,25 @@ func (a *AES) newAESWriter(keyIterations int, keySize int, hashFunction func() h
 	return &aw, nil
 }
 
-func (a *AES) newAESReader(iv []byte, keyIterations int, keySize int, hashFunction func() hash.Hash) (*AESReader, error) {
+/* newAESReader is meant to be used by internal functions.
+*  Creates a AESReader with the key derived from the salt the stream was written with.
+*  Returns AESReader, error
+ */
+func (a *AES) newAESReader(iv []byte, salt []byte, kdf KDF, keySize int) (*AESReader, error) {
 
-	derivedKey := pbkdf2.Key(a.key, nil, keyIterations, keySize, hashFunction)
+	derivedKey, err := a.deriveKey(kdf, salt, keySize)
+	if err != nil {
+		return nil, err
+	}
 	ar := AESReader{
 		BlockSize: keySize,
 		key:       derivedKey,
-		IV:        iv,
+		iv:        iv,
+		salt:      salt,
+		kdf:       kdf,
 	}
 
-	block, err := aes.NewCipher(ar.key)
+	block, err := aes.NewCipher(derivedKey)
 	if err != nil {
 		return nil, err
 	}
@@ -68,23 +146,29 @@ func (a *AES) newAESReader(iv []byte, keyIterations int, keySize int, hashFuncti
 	return &ar, nil
 }
 
-/* NewWriter is a default simple to use standard. It uses AES-256-CBC (Currently and is subject to change until a stable version 1.0 is released)
-*  Returns AESWriter, error
+/* scratchBuffer returns a buffer of n bytes, reusing buf if it is large enough, so steady state reads and writes do not allocate.
+*  The exceptions are GCM-SIV and parallel chunks, see ModeGCMSIV and Config.Workers.
+*  Returns buffer
  */
-func (a *AES) NewWriter(writer io.Writer) (*AESWriter, []byte, error) {
-
-	aw, err := a.New256CBCWriter(writer)
-	if err != nil {
-		return nil, nil, err
+func scratchBuffer(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
 	}
+	return buf[:n]
+}
 
-	return aw, aw.IV, nil
+/* NewWriter is a default simple to use standard. It uses AES-256-CBC (Currently and is subject to change until a stable version 1.0 is released)
+*  The IV and salt needed to read the stream back are available from AESWriter.IV and AESWriter.Salt
+*  Returns AESWriter, error
+ */
+func (a *AES) NewWriter(writer io.Writer) (*AESWriter, error) {
+	return a.New256CBCWriter(writer)
 }
 
 /* NewReader is a default simple to use standard. It uses AES-256-CBC (Currently and is subject to change until a stable version 1.0 is released)
 *  Returns AESReader, error.
  */
 
-func (a *AES) NewReader(reader io.Reader, iv []byte) (*AESReader, error) {
-	return a.New256CBCReader(reader, iv)
+func (a *AES) NewReader(reader io.Reader, iv []byte, salt []byte) (*AESReader, error) {
+	return a.New256CBCReader(reader, iv, salt)
 }
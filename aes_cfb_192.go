@@ -0,0 +1,35 @@
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) New192CFBWriterCustom(downstream io.Writer, keyIterations int, KeySize int, hashFunction func() hash.Hash, saltSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:     ModeCFB,
+		KeySize:  KeySize,
+		KDF:      a.keyDerivation(keyIterations, hashFunction),
+		SaltSize: saltSize,
+		NoSalt:   saltSize == 0,
+	})
+}
+
+func (a *AES) New192CFBWriter(downstream io.Writer) (*AESWriter, error) {
+	return a.New192CFBWriterCustom(downstream, 4096, KeySize192, sha512.New, DefaultSaltSize)
+}
+
+func (a *AES) New192CFBReaderCustom(upstream io.Reader, iv []byte, salt []byte, keyIterations int, KeySize int, hashFunction func() hash.Hash) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:    ModeCFB,
+		KeySize: KeySize,
+		KDF:     a.keyDerivation(keyIterations, hashFunction),
+		IV:      iv,
+		Salt:    salt,
+	})
+}
+
+func (a *AES) New192CFBReader(upstream io.Reader, iv []byte, salt []byte) (*AESReader, error) {
+	return a.New192CFBReaderCustom(upstream, iv, salt, 4096, KeySize192, sha512.New)
+}
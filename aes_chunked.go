@@ -0,0 +1,106 @@
+/*
+Chunked AEAD streams are framed as follows, with all integers big endian:
+
+	header: version (1 byte) | chunk size (4 bytes) | base nonce (aead.NonceSize() bytes)
+	chunk:  final flag (1 bit) | ciphertext length (31 bits) | ciphertext
+
+The nonce of every chunk is derived from the base nonce by XORing a chunk counter into its last 8 bytes,
+so no nonce is ever used twice within a stream, and the reader needs no out of band data besides the key.
+
+Every stream ends with a chunk carrying the final flag, which is also sealed into the chunks associated data
+(similar to the STREAM construction), after the authenticated container header fields (see header.authenticated). A stream cut off at a chunk boundary therefore lacks its final chunk,
+and a stream with chunks appended after the final chunk fails authentication.
+*/
+
+package gocrypt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidHeader error = errors.New("invalid stream header")
+var ErrTruncated error = errors.New("stream truncated")
+
+const chunkedStreamVersion = 1
+
+// maxChunkSize is the largest chunk size the default readers accept from a stream header
+const maxChunkSize = 1 << 24
+
+// chunkLengthSize is the size of the length prefix in front of every chunk
+const chunkLengthSize = 4
+
+// finalChunkFlag marks the final chunk in its length prefix
+const finalChunkFlag = 1 << 31
+
+func chunkedHeaderSize(nonceSize int) int {
+	return 1 + 4 + nonceSize
+}
+
+func marshalChunkedHeader(chunkSize int, baseNonce []byte) []byte {
+	header := make([]byte, chunkedHeaderSize(len(baseNonce)))
+	header[0] = chunkedStreamVersion
+	binary.BigEndian.PutUint32(header[1:5], uint32(chunkSize))
+	copy(header[5:], baseNonce)
+
+	return header
+}
+
+/* unmarshalChunkedHeader parses a chunked stream header, rejecting chunk sizes above maxSize.
+*  Returns chunk size, base nonce, error
+ */
+func unmarshalChunkedHeader(header []byte, maxSize int) (int, []byte, error) {
+	if len(header) < chunkedHeaderSize(0) || header[0] != chunkedStreamVersion {
+		return 0, nil, ErrInvalidHeader
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[1:5]))
+	if chunkSize <= 0 || chunkSize > maxSize {
+		return 0, nil, ErrInvalidHeader
+	}
+
+	return chunkSize, header[5:], nil
+}
+
+// chunkNonce writes the nonce for the given chunk counter into dst, which must be as long as baseNonce
+func chunkNonce(dst []byte, baseNonce []byte, counter uint64) {
+	copy(dst, baseNonce)
+
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], counter)
+	for i := range ctr {
+		dst[len(dst)-8+i] ^= ctr[i]
+	}
+}
+
+func marshalChunkLength(length int, final bool) uint32 {
+	if final {
+		return uint32(length) | finalChunkFlag
+	}
+	return uint32(length)
+}
+
+/* unmarshalChunkLength splits a length prefix into the ciphertext length and the final flag
+*  Returns length, final
+ */
+func unmarshalChunkLength(prefix uint32) (int, bool) {
+	return int(prefix &^ finalChunkFlag), prefix&finalChunkFlag != 0
+}
+
+// chunkData holds the associated data of a streams chunks, its authenticated header fields followed by the final flag
+type chunkData [2][]byte
+
+func newChunkData(authenticatedHeader []byte) chunkData {
+	return chunkData{
+		append(append([]byte{}, authenticatedHeader...), 0),
+		append(append([]byte{}, authenticatedHeader...), 1),
+	}
+}
+
+// additionalData returns the associated data a chunk is sealed with, which must not be modified
+func (c *chunkData) additionalData(final bool) []byte {
+	if final {
+		return c[1]
+	}
+	return c[0]
+}
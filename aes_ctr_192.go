@@ -0,0 +1,35 @@
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) New192CTRWriterCustom(downstream io.Writer, keyIterations int, KeySize int, hashFunction func() hash.Hash, saltSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:     ModeCTR,
+		KeySize:  KeySize,
+		KDF:      a.keyDerivation(keyIterations, hashFunction),
+		SaltSize: saltSize,
+		NoSalt:   saltSize == 0,
+	})
+}
+
+func (a *AES) New192CTRWriter(downstream io.Writer) (*AESWriter, error) {
+	return a.New192CTRWriterCustom(downstream, 4096, KeySize192, sha512.New, DefaultSaltSize)
+}
+
+func (a *AES) New192CTRReaderCustom(upstream io.Reader, iv []byte, salt []byte, keyIterations int, KeySize int, hashFunction func() hash.Hash) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:    ModeCTR,
+		KeySize: KeySize,
+		KDF:     a.keyDerivation(keyIterations, hashFunction),
+		IV:      iv,
+		Salt:    salt,
+	})
+}
+
+func (a *AES) New192CTRReader(upstream io.Reader, iv []byte, salt []byte) (*AESReader, error) {
+	return a.New192CTRReaderCustom(upstream, iv, salt, 4096, KeySize192, sha512.New)
+}
@@ -0,0 +1,71 @@
+/*
+Envelope encryption encrypts every stream under its own random data key. The data key is wrapped (RFC 3394) under the key
+derived from the password and the streams salt, and stored in the container header, so changing the password only needs
+the wrapped key in the header rewritten instead of the whole stream re-encrypted.
+*/
+
+package gocrypt
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+)
+
+/* useDataKey replaces the writers password key with a random data key, keeping the password key only to wrap it.
+*  Must be called before the cipher modes are created from the key.
+ */
+func (aw *AESWriter) useDataKey() error {
+	dataKey := make([]byte, len(aw.key))
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+
+	aw.wrappedKey = wrapKey(aw.block, dataKey)
+	wipe(aw.key)
+	aw.key = dataKey
+	aw.block = block
+
+	return nil
+}
+
+/* openDataKey unwraps the streams data key with the readers password key, and replaces the password key with it.
+*  A wrong password or modified wrapped key returns ErrKeyUnwrap.
+ */
+func (r *AESReader) openDataKey(wrappedKey []byte) error {
+	dataKey, err := unwrapKey(r.block, wrappedKey)
+	if err != nil {
+		return err
+	}
+	if len(dataKey) != len(r.key) {
+		wipe(dataKey)
+		return ErrKeyUnwrap
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+
+	r.wrappedKey = append([]byte{}, wrappedKey...)
+	wipe(r.key)
+	r.key = dataKey
+	r.block = block
+
+	return nil
+}
+
+// WrappedKey returns the wrapped data key of an envelope stream, or nil if the stream is encrypted under the password key directly
+func (aw *AESWriter) WrappedKey() []byte {
+	return aw.wrappedKey
+}
+
+// WrappedKey returns the wrapped data key of an envelope stream, or nil if the stream is encrypted under the password key directly
+func (r *AESReader) WrappedKey() []byte {
+	return r.wrappedKey
+}
@@ -0,0 +1,486 @@
+/*
+EncryptedFile is a random access file encrypted with AES-256-GCM in fixed size chunks, that can be read and overwritten at any offset.
+Only the chunks a write touches are re-encrypted, each with a fresh random nonce. The file is laid out as follows:
+
+	magic "GCRF" (4 bytes) | format version (1 byte) | KDF ID (1 byte) | KDF parameters length | KDF parameters |
+	salt length | salt | chunk size (4 bytes, big endian) | file ID (16 bytes) | size nonce | sealed plaintext size (8 bytes, big endian)
+	chunk slots: nonce | ciphertext, every slot but the last holding a full chunk
+
+The file ID is random for every file. The plaintext size is sealed with the header in front of it as associated data, and every chunk
+is sealed with the file ID and its index, so modified, moved or cut off chunks, and chunks or sizes copied from another file
+encrypted with the same password, fail authentication. Replacing a chunk with an older version of the same chunk is not detected.
+A write interrupted half way can leave chunks and the size out of step, which also fails authentication.
+
+Every file is encrypted under its own key, expanded from the derived key and the file ID with HKDF. Random 96 bit GCM nonces
+are only safe for about 2^32 seals per key, and files of an AES created with NewAESFromKey share their derived key,
+so without it every write to every such file would count against the same budget. That budget now applies to each file.
+*/
+
+package gocrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var fileMagic = []byte("GCRF")
+
+const fileVersion = 1
+
+const fileIDSize = 16
+
+const fileKeyInfo = "gocrypt file key"
+
+// FileBackend is the storage an EncryptedFile is kept in, such as *os.File
+type FileBackend interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+type EncryptedFile struct {
+	backend FileBackend
+	aead    cipher.AEAD
+
+	header     []byte // Everything in front of the sealed size, its associated data
+	fileID     []byte
+	chunkSize  int
+	dataOffset int64
+
+	size  int64
+	mutex sync.Mutex
+}
+
+/* CreateEncryptedFile starts a new, empty EncryptedFile in backend, truncating whatever it held.
+*  chunkSize is the plaintext size of every chunk, 0 uses the default. Smaller chunks make small writes cheaper, but add more overhead.
+*  Returns EncryptedFile, error
+ */
+func (a *AES) CreateEncryptedFile(backend FileBackend, chunkSize int) (*EncryptedFile, error) {
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
+	}
+	if chunkSize < 0 || chunkSize > maxChunkSize {
+		return nil, ErrInvalidChunkSize
+	}
+
+	kdf := a.keyDerivation(defaultKeyIterations, defaultHashFunction)
+	saltSize := DefaultSaltSize
+	if kdf.ID() == KDFNone {
+		saltSize = 0
+	}
+	salt, err := newSalt(saltSize)
+	if err != nil {
+		return nil, err
+	}
+
+	params := kdf.Params()
+	if len(params) > 255 || len(salt) > 255 {
+		return nil, ErrInvalidHeader
+	}
+	header := bytes.NewBuffer(nil)
+	header.Write(fileMagic)
+	header.Write([]byte{fileVersion, kdf.ID()})
+	header.WriteByte(byte(len(params)))
+	header.Write(params)
+	header.WriteByte(byte(len(salt)))
+	header.Write(salt)
+	header.Write(appendUint32(nil, uint32(chunkSize)))
+	fileID := make([]byte, fileIDSize)
+	_, err = rand.Read(fileID)
+	if err != nil {
+		return nil, err
+	}
+	header.Write(fileID)
+
+	f, err := a.newEncryptedFile(backend, header.Bytes(), kdf, salt, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = backend.Truncate(0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = backend.WriteAt(f.header, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = f.writeSize(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+/* OpenEncryptedFile opens an EncryptedFile created by CreateEncryptedFile.
+*  A wrong key, or a modified header or size, returns ErrAuthentication.
+*  A header KDF other than the one the AES was created with is held to the default KDFLimits.
+*  Returns EncryptedFile, error
+ */
+func (a *AES) OpenEncryptedFile(backend FileBackend) (*EncryptedFile, error) {
+
+	upstream := io.NewSectionReader(backend, 0, 1<<62)
+
+	fixed := make([]byte, len(fileMagic)+2)
+	err := readHeaderField(upstream, fixed)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:len(fileMagic)], fileMagic) || fixed[len(fileMagic)] != fileVersion {
+		return nil, ErrInvalidHeader
+	}
+
+	params, err := readHeaderBytes(upstream)
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := ParseKDF(fixed[len(fileMagic)+1], params)
+	if err != nil {
+		return nil, err
+	}
+	err = KDFLimits{}.check(kdf, a.keyDerivation(defaultKeyIterations, defaultHashFunction))
+	if err != nil {
+		return nil, err
+	}
+	salt, err := readHeaderBytes(upstream)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := make([]byte, 4)
+	err = readHeaderField(upstream, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	err = readHeaderField(upstream, make([]byte, fileIDSize))
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize, _ := upstream.Seek(0, io.SeekCurrent)
+	header := make([]byte, headerSize)
+	read, err := backend.ReadAt(header, 0)
+	if read < len(header) {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, ErrInvalidHeader
+	}
+
+	f, err := a.newEncryptedFile(backend, header, kdf, salt, int(binary.BigEndian.Uint32(chunkSize)))
+	if err != nil {
+		return nil, err
+	}
+
+	//A full read may come with io.EOF at the end of the backend, only a short one is truncated
+	sealed := make([]byte, f.aead.NonceSize()+8+f.aead.Overhead())
+	read, err = backend.ReadAt(sealed, headerSize)
+	if read < len(sealed) {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, ErrInvalidHeader
+	}
+	size, err := f.aead.Open(nil, sealed[:f.aead.NonceSize()], sealed[f.aead.NonceSize():], f.header)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	f.size = int64(binary.BigEndian.Uint64(size))
+	if f.size < 0 {
+		return nil, ErrInvalidHeader
+	}
+
+	return f, nil
+}
+
+func (a *AES) newEncryptedFile(backend FileBackend, header []byte, kdf KDF, salt []byte, chunkSize int) (*EncryptedFile, error) {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, ErrInvalidHeader
+	}
+
+	key, err := a.deriveKey(kdf, salt, KeySize256)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	fileID := header[len(header)-fileIDSize:]
+	fileKey := make([]byte, KeySize256)
+	defer wipe(fileKey)
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, fileID, []byte(fileKeyInfo)), fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedFile{
+		backend:    backend,
+		aead:       aead,
+		header:     header,
+		fileID:     fileID,
+		chunkSize:  chunkSize,
+		dataOffset: int64(len(header) + aead.NonceSize() + 8 + aead.Overhead()),
+	}, nil
+}
+
+// Size returns the plaintext size of the file
+func (f *EncryptedFile) Size() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.size
+}
+
+/* ReadAt decrypts len(dst) bytes starting at plaintext offset off, as io.ReaderAt.
+*  Returns read, error
+ */
+func (f *EncryptedFile) ReadAt(dst []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	read := 0
+	for read < len(dst) && off < f.size {
+		index := off / int64(f.chunkSize)
+		plainText, err := f.readChunk(index)
+		if err != nil {
+			return read, err
+		}
+
+		copied := copy(dst[read:], plainText[off-index*int64(f.chunkSize):])
+		read += copied
+		off += int64(copied)
+	}
+
+	if read < len(dst) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+/* WriteAt encrypts src at plaintext offset off, as io.WriterAt. Writing past the end grows the file, filling any gap with zeros.
+*  Only the chunks src overlaps, and those of the gap, are re-encrypted. On error, written counts the bytes of src already committed.
+*  Returns written, error
+ */
+func (f *EncryptedFile) WriteAt(src []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	if len(src) == 0 {
+		return 0, nil
+	}
+
+	end := off + int64(len(src))
+	newSize := f.size
+	if end > newSize {
+		newSize = end
+	}
+
+	start := off
+	if f.size < start {
+		start = f.size
+	}
+	committed := start
+	for index := start / int64(f.chunkSize); index <= (end-1)/int64(f.chunkSize); index++ {
+		err := f.rewriteChunk(index, newSize, src, off)
+		if err != nil {
+			//Chunks written past the end only count once the size covers them, committed ends on a chunk boundary there
+			if committed > f.size && f.writeSize(committed) != nil {
+				committed = f.size
+			}
+			return committedBytes(off, committed), err
+		}
+
+		committed = (index + 1) * int64(f.chunkSize)
+		if committed > end {
+			committed = end
+		}
+	}
+
+	if newSize != f.size {
+		err := f.writeSize(newSize)
+		if err != nil {
+			return committedBytes(off, f.size), err
+		}
+	}
+
+	return len(src), nil
+}
+
+/* Truncate changes the plaintext size of the file, growing it with zeros or cutting it off.
+*  Returns error
+ */
+func (f *EncryptedFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if size < 0 {
+		return ErrInvalidOffset
+	}
+
+	switch {
+	case size > f.size:
+		for index := f.size / int64(f.chunkSize); index <= (size-1)/int64(f.chunkSize); index++ {
+			err := f.rewriteChunk(index, size, nil, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return f.writeSize(size)
+
+	case size < f.size:
+		//The new last chunk is only re-encrypted if it is cut in the middle
+		if size%int64(f.chunkSize) != 0 {
+			err := f.rewriteChunk(size/int64(f.chunkSize), size, nil, 0)
+			if err != nil {
+				return err
+			}
+		}
+		err := f.writeSize(size)
+		if err != nil {
+			return err
+		}
+		return f.backend.Truncate(f.backendSize(size))
+	}
+
+	return nil
+}
+
+// committedBytes returns how many bytes of a write at offset off are committed when everything before committed is
+func committedBytes(off int64, committed int64) int {
+	if committed <= off {
+		return 0
+	}
+	return int(committed - off)
+}
+
+// slotOffset returns where the slot of the chunk with the given index starts in the backend
+func (f *EncryptedFile) slotOffset(index int64) int64 {
+	return f.dataOffset + index*int64(f.aead.NonceSize()+f.chunkSize+f.aead.Overhead())
+}
+
+// chunkLength returns the plaintext length of the chunk with the given index, in a file of the given size
+func (f *EncryptedFile) chunkLength(index int64, size int64) int {
+	length := size - index*int64(f.chunkSize)
+	if length > int64(f.chunkSize) {
+		return f.chunkSize
+	}
+	return int(length)
+}
+
+// backendSize returns the size of the backend holding size bytes of plaintext
+func (f *EncryptedFile) backendSize(size int64) int64 {
+	if size == 0 {
+		return f.dataOffset
+	}
+	last := (size - 1) / int64(f.chunkSize)
+	return f.slotOffset(last) + int64(f.aead.NonceSize()+f.chunkLength(last, size)+f.aead.Overhead())
+}
+
+/* readChunk reads and decrypts the chunk with the given index.
+*  Returns plaintext, error
+ */
+func (f *EncryptedFile) readChunk(index int64) ([]byte, error) {
+	slot := make([]byte, f.aead.NonceSize()+f.chunkLength(index, f.size)+f.aead.Overhead())
+	read, err := f.backend.ReadAt(slot, f.slotOffset(index))
+	if read < len(slot) {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, ErrTruncated
+	}
+
+	plainText, err := f.aead.Open(nil, slot[:f.aead.NonceSize()], slot[f.aead.NonceSize():], f.chunkData(index))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plainText, nil
+}
+
+/* rewriteChunk re-encrypts the chunk with the given index for a file of newSize bytes,
+*  keeping its current plaintext where src, which starts at offset off, does not overlap it.
+ */
+func (f *EncryptedFile) rewriteChunk(index int64, newSize int64, src []byte, off int64) error {
+	chunkStart := index * int64(f.chunkSize)
+	plainText := make([]byte, f.chunkLength(index, newSize))
+
+	if chunkStart < f.size {
+		current, err := f.readChunk(index)
+		if err != nil {
+			return err
+		}
+		copy(plainText, current)
+	}
+
+	if off < chunkStart+int64(len(plainText)) && off+int64(len(src)) > chunkStart {
+		if off >= chunkStart {
+			copy(plainText[off-chunkStart:], src)
+		} else {
+			copy(plainText, src[chunkStart-off:])
+		}
+	}
+
+	slot := make([]byte, f.aead.NonceSize(), f.aead.NonceSize()+len(plainText)+f.aead.Overhead())
+	_, err := rand.Read(slot)
+	if err != nil {
+		return err
+	}
+	slot = f.aead.Seal(slot, slot, plainText, f.chunkData(index))
+
+	_, err = f.backend.WriteAt(slot, f.slotOffset(index))
+	return err
+}
+
+// writeSize seals the plaintext size into the header with a fresh nonce
+func (f *EncryptedFile) writeSize(size int64) error {
+	sealed := make([]byte, f.aead.NonceSize(), f.aead.NonceSize()+8+f.aead.Overhead())
+	_, err := rand.Read(sealed)
+	if err != nil {
+		return err
+	}
+
+	plainText := make([]byte, 8)
+	binary.BigEndian.PutUint64(plainText, uint64(size))
+	sealed = f.aead.Seal(sealed, sealed, plainText, f.header)
+
+	_, err = f.backend.WriteAt(sealed, int64(len(f.header)))
+	if err != nil {
+		return err
+	}
+
+	f.size = size
+	return nil
+}
+
+// chunkData returns the associated data a file chunk is sealed with, the file ID and the chunk index
+func (f *EncryptedFile) chunkData(index int64) []byte {
+	data := make([]byte, len(f.fileID)+8)
+	copy(data, f.fileID)
+	binary.BigEndian.PutUint64(data[len(f.fileID):], uint64(index))
+	return data
+}
@@ -0,0 +1,40 @@
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) New128GCMWriterCustom(downstream io.Writer, keyIterations int, keySize int, hashFunction func() hash.Hash, saltSize int, chunkSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:      ModeGCM,
+		KeySize:   keySize,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		SaltSize:  saltSize,
+		NoSalt:    saltSize == 0,
+		ChunkSize: chunkSize,
+	})
+}
+
+func (a *AES) New128GCMWriter(downstream io.Writer) (*AESWriter, error) {
+	return a.New128GCMWriterCustom(downstream, 4096, KeySize128, sha512.New, DefaultSaltSize, defaultChunkSize)
+}
+
+//Readers
+
+/* New128GCMReaderCustom reads the chunk size from the stream header, chunkSize is the largest chunk size it will accept.
+ */
+func (a *AES) New128GCMReaderCustom(upstream io.Reader, salt []byte, keyIterations int, KeySize int, hashFunction func() hash.Hash, chunkSize int) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:      ModeGCM,
+		KeySize:   KeySize,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		ChunkSize: chunkSize,
+		Salt:      salt,
+	})
+}
+
+func (a *AES) New128GCMReader(upstream io.Reader, salt []byte) (*AESReader, error) {
+	return a.New128GCMReaderCustom(upstream, salt, 4096, KeySize128, sha512.New, maxChunkSize)
+}
@@ -0,0 +1,287 @@
+/*
+AES-GCM-SIV (RFC 8452) is a nonce misuse resistant AEAD. Sealing the same chunk twice with the same nonce
+only reveals that the two chunks are equal, instead of breaking confidentiality and authenticity like GCM.
+
+The tag is computed over the plaintext with POLYVAL first, and then used as the initial counter for encryption,
+so every chunk effectively gets a synthetic IV.
+*/
+
+package gocrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+)
+
+var errGCMSIVOpen error = errors.New("gcm-siv: message authentication failed")
+
+const gcmSIVNonceSize = 12
+const gcmSIVTagSize = 16
+
+// gcmSIVMaxSize is the largest plaintext, ciphertext and additional data RFC 8452 allows
+const gcmSIVMaxSize = 1 << 36
+
+type gcmSIV struct {
+	keyGenerating cipher.Block
+	keySize       int
+}
+
+// gcmSIVBlocks are the blocks given to cipher.Block, pooled as they would otherwise escape to the heap on every message
+type gcmSIVBlocks struct {
+	input, output [16]byte
+}
+
+var gcmSIVBlockPool = sync.Pool{New: func() interface{} { return new(gcmSIVBlocks) }}
+
+/* newGCMSIV creates an AES-GCM-SIV AEAD, the key must be 16 or 32 bytes long.
+*  Like crypto/cipher's GCM it is safe for concurrent use.
+*  Returns AEAD, error
+ */
+func newGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize128 && len(key) != KeySize256 {
+		return nil, ErrInvalidKeySize
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcmSIV{keyGenerating: block, keySize: len(key)}, nil
+}
+
+func (g *gcmSIV) NonceSize() int {
+	return gcmSIVNonceSize
+}
+
+func (g *gcmSIV) Overhead() int {
+	return gcmSIVTagSize
+}
+
+/* deriveKeys derives the per nonce POLYVAL authentication key and AES encryption key.
+*  The encryption keys schedule is the only allocation GCM-SIV makes per message, see gcmSIVBlocks.
+ */
+func (g *gcmSIV) deriveKeys(blocks *gcmSIVBlocks, nonce []byte) ([16]byte, cipher.Block) {
+	blocks.input = [16]byte{}
+	copy(blocks.input[4:], nonce)
+
+	var derived [16 + KeySize256]byte
+	for i := 0; i*8 < 16+g.keySize; i++ {
+		binary.LittleEndian.PutUint32(blocks.input[:4], uint32(i))
+		g.keyGenerating.Encrypt(blocks.output[:], blocks.input[:])
+		copy(derived[i*8:], blocks.output[:8])
+	}
+
+	var authKey [16]byte
+	copy(authKey[:], derived[:16])
+
+	//The encryption key is either 16 or 32 bytes, so NewCipher can not fail
+	encryption, _ := aes.NewCipher(derived[16 : 16+g.keySize])
+	return authKey, encryption
+}
+
+func (g *gcmSIV) tag(blocks *gcmSIVBlocks, authKey [16]byte, encryption cipher.Block, nonce []byte, plainText []byte, additionalData []byte) [16]byte {
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plainText))*8)
+
+	p := newPolyval(authKey[:])
+	p.update(additionalData)
+	p.update(plainText)
+	p.update(lengths[:])
+
+	blocks.input = p.sum()
+	for i := range nonce {
+		blocks.input[i] ^= nonce[i]
+	}
+	blocks.input[15] &= 0x7f
+
+	encryption.Encrypt(blocks.output[:], blocks.input[:])
+	return blocks.output
+}
+
+// crypt is AES-CTR with a 32 bit little endian counter in the first four bytes, starting at the tag
+func (g *gcmSIV) crypt(blocks *gcmSIVBlocks, encryption cipher.Block, tag [16]byte, dst []byte, src []byte) {
+	counter, keyStream := &blocks.input, &blocks.output
+	*counter = tag
+	counter[15] |= 0x80
+	ctr := binary.LittleEndian.Uint32(counter[:4])
+
+	for len(src) > 0 {
+		binary.LittleEndian.PutUint32(counter[:4], ctr)
+		encryption.Encrypt(keyStream[:], counter[:])
+		ctr++
+
+		n := len(src)
+		if n > len(keyStream) {
+			n = len(keyStream)
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ keyStream[i]
+		}
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plainText, additionalData []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("gcm-siv: incorrect nonce length given to GCM-SIV")
+	}
+	if uint64(len(plainText)) > gcmSIVMaxSize || uint64(len(additionalData)) > gcmSIVMaxSize {
+		panic("gcm-siv: message too large for GCM-SIV")
+	}
+
+	blocks := gcmSIVBlockPool.Get().(*gcmSIVBlocks)
+	defer gcmSIVBlockPool.Put(blocks)
+
+	authKey, encryption := g.deriveKeys(blocks, nonce)
+	tag := g.tag(blocks, authKey, encryption, nonce, plainText, additionalData)
+
+	ret, out := sliceForAppend(dst, len(plainText)+gcmSIVTagSize)
+	g.crypt(blocks, encryption, tag, out, plainText)
+	copy(out[len(plainText):], tag[:])
+
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, cipherText, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("gcm-siv: incorrect nonce length given to GCM-SIV")
+	}
+	if len(cipherText) < gcmSIVTagSize || uint64(len(cipherText)) > gcmSIVMaxSize+gcmSIVTagSize || uint64(len(additionalData)) > gcmSIVMaxSize {
+		return nil, errGCMSIVOpen
+	}
+
+	var tag [16]byte
+	copy(tag[:], cipherText[len(cipherText)-gcmSIVTagSize:])
+	cipherText = cipherText[:len(cipherText)-gcmSIVTagSize]
+
+	blocks := gcmSIVBlockPool.Get().(*gcmSIVBlocks)
+	defer gcmSIVBlockPool.Put(blocks)
+
+	authKey, encryption := g.deriveKeys(blocks, nonce)
+
+	ret, out := sliceForAppend(dst, len(cipherText))
+	g.crypt(blocks, encryption, tag, out, cipherText)
+
+	expected := g.tag(blocks, authKey, encryption, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errGCMSIVOpen
+	}
+
+	return ret, nil
+}
+
+/* sliceForAppend extends in by n bytes, reusing its capacity where possible, like crypto/cipher does.
+*  Returns the extended slice, and the n bytes appended
+ */
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+/*
+POLYVAL works in GF(2^128) with the polynomial x^128 + x^127 + x^126 + x^121 + 1, with little endian elements,
+where the multiplication dot(a, b) = a * b * x^-128.
+*/
+type polyval struct {
+	hLow, hHigh uint64
+	sLow, sHigh uint64
+}
+
+func newPolyval(key []byte) *polyval {
+	return &polyval{
+		hLow:  binary.LittleEndian.Uint64(key[:8]),
+		hHigh: binary.LittleEndian.Uint64(key[8:]),
+	}
+}
+
+// update absorbs data, zero padded to a multiple of 16 bytes
+func (p *polyval) update(data []byte) {
+	var block [16]byte
+	for len(data) > 0 {
+		n := copy(block[:], data)
+		for i := n; i < 16; i++ {
+			block[i] = 0
+		}
+		data = data[n:]
+
+		p.sLow ^= binary.LittleEndian.Uint64(block[:8])
+		p.sHigh ^= binary.LittleEndian.Uint64(block[8:])
+		p.sLow, p.sHigh = polyvalDot(p.sLow, p.sHigh, p.hLow, p.hHigh)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var s [16]byte
+	binary.LittleEndian.PutUint64(s[:8], p.sLow)
+	binary.LittleEndian.PutUint64(s[8:], p.sHigh)
+	return s
+}
+
+/* polyvalDot multiplies a and b word by word with Karatsuba, then reduces the 256 bit product by x^128,
+*  so the result is a * b * x^-128. Constant time, it does not leak the bits of the key.
+ */
+func polyvalDot(aLow, aHigh, bLow, bHigh uint64) (uint64, uint64) {
+	z0High, z0Low := clmul64(aLow, bLow)
+	z2High, z2Low := clmul64(aHigh, bHigh)
+	z1High, z1Low := clmul64(aLow^aHigh, bLow^bHigh)
+	z1High ^= z0High ^ z2High
+	z1Low ^= z0Low ^ z2Low
+
+	r0, r1, r2, r3 := z0Low, z0High^z1Low, z2Low^z1High, z2High
+
+	//Divide by x^64 twice, first adding the multiple of the polynomial that clears the lowest word.
+	//The polynomial is 1 below x^64, so that multiple is the lowest word times it, x^121 + x^126 + x^127 + x^128 shifted down by 64
+	r1 ^= r0<<57 ^ r0<<62 ^ r0<<63
+	r2 ^= r0 ^ r0>>1 ^ r0>>2 ^ r0>>7
+	r2 ^= r1<<57 ^ r1<<62 ^ r1<<63
+	r3 ^= r1 ^ r1>>1 ^ r1>>2 ^ r1>>7
+
+	return r2, r3
+}
+
+/* clmul64 is the carry-less product of x and y. The high half is the low half of the product of the bit reversed inputs,
+*  reversed again, as in BearSSL.
+*  Returns high, low
+ */
+func clmul64(x, y uint64) (uint64, uint64) {
+	low := bmul64(x, y)
+	high := bits.Reverse64(bmul64(bits.Reverse64(x), bits.Reverse64(y))) >> 1
+	return high, low
+}
+
+/* bmul64 is the low 64 bits of the carry-less product of x and y, with integer multiplications.
+*  Every fourth bit is multiplied separately, so the carries of a bit, summing at most 15 terms below bit 60, never reach the next bit kept.
+ */
+func bmul64(x, y uint64) uint64 {
+	x0 := x & 0x1111111111111111
+	x1 := x & 0x2222222222222222
+	x2 := x & 0x4444444444444444
+	x3 := x & 0x8888888888888888
+	y0 := y & 0x1111111111111111
+	y1 := y & 0x2222222222222222
+	y2 := y & 0x4444444444444444
+	y3 := y & 0x8888888888888888
+
+	z0 := (x0 * y0) ^ (x1 * y3) ^ (x2 * y2) ^ (x3 * y1)
+	z1 := (x0 * y1) ^ (x1 * y0) ^ (x2 * y3) ^ (x3 * y2)
+	z2 := (x0 * y2) ^ (x1 * y1) ^ (x2 * y0) ^ (x3 * y3)
+	z3 := (x0 * y3) ^ (x1 * y2) ^ (x2 * y1) ^ (x3 * y0)
+
+	return z0&0x1111111111111111 | z1&0x2222222222222222 | z2&0x4444444444444444 | z3&0x8888888888888888
+}
@@ -0,0 +1,40 @@
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) New128GCMSIVWriterCustom(downstream io.Writer, keyIterations int, keySize int, hashFunction func() hash.Hash, saltSize int, chunkSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:      ModeGCMSIV,
+		KeySize:   keySize,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		SaltSize:  saltSize,
+		NoSalt:    saltSize == 0,
+		ChunkSize: chunkSize,
+	})
+}
+
+func (a *AES) New128GCMSIVWriter(downstream io.Writer) (*AESWriter, error) {
+	return a.New128GCMSIVWriterCustom(downstream, 4096, KeySize128, sha512.New, DefaultSaltSize, defaultChunkSize)
+}
+
+//Readers
+
+/* New128GCMSIVReaderCustom reads the chunk size from the stream header, chunkSize is the largest chunk size it will accept.
+ */
+func (a *AES) New128GCMSIVReaderCustom(upstream io.Reader, salt []byte, keyIterations int, KeySize int, hashFunction func() hash.Hash, chunkSize int) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:      ModeGCMSIV,
+		KeySize:   KeySize,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		ChunkSize: chunkSize,
+		Salt:      salt,
+	})
+}
+
+func (a *AES) New128GCMSIVReader(upstream io.Reader, salt []byte) (*AESReader, error) {
+	return a.New128GCMSIVReaderCustom(upstream, salt, 4096, KeySize128, sha512.New, maxChunkSize)
+}
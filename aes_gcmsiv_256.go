@@ -0,0 +1,45 @@
+/*
+AES-GCM-SIV streams use the same chunked framing as GCM, described in aes_chunked.go
+The AEAD itself is implemented in aes_gcmsiv.go
+*/
+
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) New256GCMSIVWriterCustom(downstream io.Writer, keyIterations int, keySize int, hashFunction func() hash.Hash, saltSize int, chunkSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:      ModeGCMSIV,
+		KeySize:   keySize,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		SaltSize:  saltSize,
+		NoSalt:    saltSize == 0,
+		ChunkSize: chunkSize,
+	})
+}
+
+func (a *AES) New256GCMSIVWriter(downstream io.Writer) (*AESWriter, error) {
+	return a.New256GCMSIVWriterCustom(downstream, 4096, KeySize256, sha512.New, DefaultSaltSize, defaultChunkSize)
+}
+
+//Readers
+
+/* New256GCMSIVReaderCustom reads the chunk size from the stream header, chunkSize is the largest chunk size it will accept.
+ */
+func (a *AES) New256GCMSIVReaderCustom(upstream io.Reader, salt []byte, keyIterations int, KeySize int, hashFunction func() hash.Hash, chunkSize int) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:      ModeGCMSIV,
+		KeySize:   KeySize,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		ChunkSize: chunkSize,
+		Salt:      salt,
+	})
+}
+
+func (a *AES) New256GCMSIVReader(upstream io.Reader, salt []byte) (*AESReader, error) {
+	return a.New256GCMSIVReaderCustom(upstream, salt, 4096, KeySize256, sha512.New, maxChunkSize)
+}
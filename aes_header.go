@@ -0,0 +1,303 @@
+/*
+The optional container header makes a stream self-describing, so it can be read with AES.OpenReader
+without remembering which constructor wrote it. All lengths are single bytes.
+
+	magic "GCRY" (4 bytes) | format version (1 byte) | mode (1 byte) | key size (1 byte) |
+	KDF ID (1 byte) | KDF parameters length | KDF parameters | salt length | salt | IV length | IV |
+	MAC hash ID (1 byte, 0 without a MAC) | wrapped data key length | wrapped data key (format version 2 only)
+
+Envelope streams are written with format version 2, everything else with version 1.
+GCM streams have an empty IV, their nonce is part of the chunked stream header that follows.
+Every field but the KDF, salt and wrapped data key is authenticated: it is the start of the MAC input, and of the associated data
+of every chunk (see header.authenticated). The KDF and salt determine the key and the wrapped key has its own integrity check,
+so a modified one fails as well, while Rekey can still replace them without touching the body.
+Streams without a MAC in a non AEAD mode are not authenticated at all. As a header can also claim that, readers of untrusted
+streams should use OpenAuthenticatedReader, so a header with its MAC stripped fails instead of being read unverified.
+*/
+
+package gocrypt
+
+import (
+	"bytes"
+	"io"
+)
+
+var headerMagic = []byte("GCRY")
+
+const headerVersion = 1
+
+// headerVersionEnvelope adds the wrapped data key
+const headerVersionEnvelope = 2
+
+type header struct {
+	mode    Mode
+	keySize int
+	kdf     KDF
+	salt    []byte
+	iv      []byte
+	macHash byte
+
+	wrappedKey []byte
+}
+
+func (h *header) marshal() ([]byte, error) {
+	params := h.kdf.Params()
+	if len(params) > 255 || len(h.salt) > 255 || len(h.iv) > 255 || len(h.wrappedKey) > 255 {
+		return nil, ErrInvalidHeader
+	}
+
+	version := byte(headerVersion)
+	if h.wrappedKey != nil {
+		version = headerVersionEnvelope
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(headerMagic)
+	buf.Write([]byte{version, byte(h.mode), byte(h.keySize), h.kdf.ID()})
+	buf.WriteByte(byte(len(params)))
+	buf.Write(params)
+	buf.WriteByte(byte(len(h.salt)))
+	buf.Write(h.salt)
+	buf.WriteByte(byte(len(h.iv)))
+	buf.Write(h.iv)
+	buf.WriteByte(h.macHash)
+	if h.wrappedKey != nil {
+		buf.WriteByte(byte(len(h.wrappedKey)))
+		buf.Write(h.wrappedKey)
+	}
+
+	return buf.Bytes(), nil
+}
+
+/* authenticated returns the header fields covered by the MAC or the chunks associated data.
+*  The KDF, salt and wrapped data key are left out, so Rekey can replace them.
+ */
+func (h *header) authenticated() []byte {
+	version := byte(headerVersion)
+	if h.wrappedKey != nil {
+		version = headerVersionEnvelope
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(headerMagic)
+	buf.Write([]byte{version, byte(h.mode), byte(h.keySize)})
+	buf.WriteByte(byte(len(h.iv)))
+	buf.Write(h.iv)
+	buf.WriteByte(h.macHash)
+
+	return buf.Bytes()
+}
+
+/* readHeader reads and parses a header from upstream, consuming exactly the header bytes.
+*  Returns header, error
+ */
+func readHeader(upstream io.Reader) (*header, error) {
+
+	fixed := make([]byte, len(headerMagic)+4)
+	err := readHeaderField(upstream, fixed)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:len(headerMagic)], headerMagic) {
+		return nil, ErrInvalidHeader
+	}
+	version := fixed[len(headerMagic)]
+	if version != headerVersion && version != headerVersionEnvelope {
+		return nil, ErrInvalidHeader
+	}
+
+	h := header{
+		mode:    Mode(fixed[len(headerMagic)+1]),
+		keySize: int(fixed[len(headerMagic)+2]),
+	}
+
+	params, err := readHeaderBytes(upstream)
+	if err != nil {
+		return nil, err
+	}
+	h.kdf, err = ParseKDF(fixed[len(headerMagic)+3], params)
+	if err != nil {
+		return nil, err
+	}
+
+	h.salt, err = readHeaderBytes(upstream)
+	if err != nil {
+		return nil, err
+	}
+	h.iv, err = readHeaderBytes(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	macHash := make([]byte, 1)
+	err = readHeaderField(upstream, macHash)
+	if err != nil {
+		return nil, err
+	}
+	h.macHash = macHash[0]
+	if h.macHash != hashUnknown && hashFunctionFromID(h.macHash) == nil {
+		return nil, ErrInvalidHeader
+	}
+
+	if version == headerVersionEnvelope {
+		h.wrappedKey, err = readHeaderBytes(upstream)
+		if err != nil {
+			return nil, err
+		}
+		if len(h.wrappedKey) == 0 {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	return &h, nil
+}
+
+// readHeaderBytes reads a single byte length prefixed field
+func readHeaderBytes(upstream io.Reader) ([]byte, error) {
+	length := make([]byte, 1)
+	err := readHeaderField(upstream, length)
+	if err != nil {
+		return nil, err
+	}
+
+	field := make([]byte, length[0])
+	return field, readHeaderField(upstream, field)
+}
+
+func readHeaderField(upstream io.Reader, field []byte) error {
+	_, err := io.ReadFull(upstream, field)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidHeader
+	}
+	return err
+}
+
+/* OpenReader reads the container header written by AESWriter.EnableHeader from upstream,
+*  and returns a reader for whichever mode, key size, KDF and MAC the stream was written with.
+*  Use OpenAuthenticatedReader to refuse unauthenticated streams.
+*  A header KDF other than the one the AES was created with is held to the default KDFLimits.
+*  Returns AESReader, error
+ */
+func (a *AES) OpenReader(upstream io.Reader) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{Header: true})
+}
+
+/* OpenAuthenticatedReader is OpenReader for untrusted streams. It fails with ErrNotAuthenticated unless the stream
+*  has a MAC or uses an AEAD mode, so a header with its MAC stripped is refused instead of read unverified.
+*  Returns AESReader, error
+ */
+func (a *AES) OpenAuthenticatedReader(upstream io.Reader) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{Header: true, RequireAuthentication: true})
+}
+
+// apply returns config with the stream description replaced by the headers, keeping the reader only options
+func (h *header) apply(config Config) Config {
+	config.Header = false
+	config.Mode = h.mode
+	config.KeySize = h.keySize
+	config.KDF = h.kdf
+	config.MAC = hashFunctionFromID(h.macHash)
+	config.IV = h.iv
+	config.Salt = h.salt
+	config.WrappedKey = h.wrappedKey
+
+	return config
+}
+
+/*
+* EnableHeader() writes a container header in front of the stream, so it can be read back with AES.OpenReader.
+* The header is written on the first Write or on Close. Must be called before the first Write.
+ */
+func (aw *AESWriter) EnableHeader() error {
+	if aw.started {
+		return ErrStreamStarted
+	}
+
+	aw.containerHeader = true
+	return nil
+}
+
+/*
+* Header() returns the container header describing the stream, whether or not EnableHeader writes it into the stream.
+* Stored out of band, it can be put in front of the stream for AES.OpenReader later.
+* Returns nil if the MAC hash function can not be recorded.
+ */
+func (aw *AESWriter) Header() []byte {
+	h := aw.description()
+	if aw.mac != nil && h.macHash == hashUnknown {
+		return nil
+	}
+
+	encoded, err := h.marshal()
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+/* Header() returns the container header describing the stream, as read by AES.OpenReader or rebuilt from the readers options.
+ * Returns nil if the MAC hash function can not be recorded.
+ */
+func (r *AESReader) Header() []byte {
+	h := r.description()
+	if r.mac != nil && h.macHash == hashUnknown {
+		return nil
+	}
+
+	encoded, err := h.marshal()
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// description returns the header describing the stream, the MAC hash ID is hashUnknown if it can not be recorded
+func (aw *AESWriter) description() header {
+	h := header{
+		mode:    aw.mode,
+		keySize: len(aw.key),
+		kdf:     aw.kdf,
+		salt:    aw.salt,
+		iv:      aw.IV(),
+
+		wrappedKey: aw.wrappedKey,
+	}
+	if aw.mac != nil {
+		h.macHash = hashFunctionID(aw.mac.hashFunction)
+	}
+	return h
+}
+
+// description returns the header describing the stream, the MAC hash ID is hashUnknown if it can not be recorded
+func (r *AESReader) description() header {
+	h := header{
+		mode:    r.mode,
+		keySize: len(r.key),
+		kdf:     r.kdf,
+		salt:    r.salt,
+		iv:      r.IV(),
+
+		wrappedKey: r.wrappedKey,
+	}
+	if r.mac != nil {
+		h.macHash = hashFunctionID(r.mac.hashFunction)
+	}
+	return h
+}
+
+// writeContainerHeader writes the header in front of everything else, bypassing the MAC
+func (aw *AESWriter) writeContainerHeader() error {
+	encoded := aw.Header()
+	if encoded == nil {
+		return ErrInvalidHeader
+	}
+
+	downstream := aw.downstream
+	if aw.mac != nil {
+		downstream = aw.mac.downstream
+	}
+
+	aw.containerHeaderWritten = true
+	_, err := downstream.Write(encoded)
+	return err
+}
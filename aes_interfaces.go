@@ -0,0 +1,29 @@
+package gocrypt
+
+import (
+	"io"
+	"os"
+)
+
+// Writer is implemented by every writer the package returns, regardless of mode
+type Writer interface {
+	io.WriteCloser
+	IV() []byte
+	Header() []byte
+}
+
+// Reader is implemented by every reader the package returns, regardless of mode
+type Reader interface {
+	io.Reader
+	IV() []byte
+	Header() []byte
+}
+
+var _ Writer = (*AESWriter)(nil)
+var _ Reader = (*AESReader)(nil)
+var _ io.ReadSeeker = (*AESReader)(nil)
+var _ io.ReaderAt = (*AESReader)(nil)
+
+var _ io.ReaderAt = (*EncryptedFile)(nil)
+var _ io.WriterAt = (*EncryptedFile)(nil)
+var _ FileBackend = (*os.File)(nil)
@@ -0,0 +1,344 @@
+/*
+Key derivation functions turning the password given to NewAES into the cipher key.
+
+Every KDF can be recorded as its ID and encoded parameters, which ParseKDF turns back into
+the same KDF, so a reader can reproduce the key a writer derived.
+As the parameters come from headers that may be forged, ParseKDF rejects any above the maximums
+below rather than spending unbounded time or memory deriving a key. As even those take minutes and a GiB of memory,
+readers also hold the KDF a header names to KDFLimits, close to the defaults the package writes with, before deriving a key.
+*/
+
+package gocrypt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+var ErrUnknownKDF error = errors.New("unknown key derivation function")
+var ErrInvalidKDFParams error = errors.New("invalid key derivation parameters")
+var ErrKDFLimit error = errors.New("key derivation parameters exceed the limits")
+
+// KDF IDs, as recorded alongside the parameters
+const (
+	KDFNone     = 0
+	KDFPBKDF2   = 1
+	KDFArgon2id = 2
+	KDFScrypt   = 3
+)
+
+// The largest parameters ParseKDF accepts
+const (
+	MaxPBKDF2Iterations = 10000000
+	MaxArgon2idTime     = 64
+	MaxArgon2idMemory   = 1024 * 1024 // KiB, 1 GiB
+	MaxArgon2idThreads  = 64
+	MaxScryptMemory     = 1024 * 1024 * 1024 // bytes, scrypt uses 128 * N * R
+	MaxScryptP          = 16
+)
+
+// KDFLimits bound the KDF parameters a header may name, zero fields use the defaults from defaultKDFLimits
+type KDFLimits struct {
+	PBKDF2Iterations int
+	Argon2idTime     uint32
+	Argon2idMemory   uint32 // KiB
+	Argon2idThreads  uint8
+	ScryptMemory     int // bytes, scrypt uses 128 * N * R
+	ScryptP          int
+}
+
+// defaultKDFLimits allow a little more than NewArgon2idKDF and NewScryptKDF, and PBKDF2 up to the commonly recommended iterations for SHA-512
+var defaultKDFLimits = KDFLimits{
+	PBKDF2Iterations: 210000,
+	Argon2idTime:     3,
+	Argon2idMemory:   128 * 1024,
+	Argon2idThreads:  16,
+	ScryptMemory:     64 * 1024 * 1024,
+	ScryptP:          4,
+}
+
+/* withDefaults fills the zero fields of l from defaultKDFLimits.
+*  Returns KDFLimits
+ */
+func (l KDFLimits) withDefaults() KDFLimits {
+	if l.PBKDF2Iterations == 0 {
+		l.PBKDF2Iterations = defaultKDFLimits.PBKDF2Iterations
+	}
+	if l.Argon2idTime == 0 {
+		l.Argon2idTime = defaultKDFLimits.Argon2idTime
+	}
+	if l.Argon2idMemory == 0 {
+		l.Argon2idMemory = defaultKDFLimits.Argon2idMemory
+	}
+	if l.Argon2idThreads == 0 {
+		l.Argon2idThreads = defaultKDFLimits.Argon2idThreads
+	}
+	if l.ScryptMemory == 0 {
+		l.ScryptMemory = defaultKDFLimits.ScryptMemory
+	}
+	if l.ScryptP == 0 {
+		l.ScryptP = defaultKDFLimits.ScryptP
+	}
+	return l
+}
+
+/* check fails with ErrKDFLimit if kdf, read from a header, costs more than the limits allow.
+*  trusted is the KDF the caller configured, which is always allowed.
+*  Returns error
+ */
+func (l KDFLimits) check(kdf KDF, trusted KDF) error {
+	if trusted != nil && kdf.ID() == trusted.ID() && bytes.Equal(kdf.Params(), trusted.Params()) {
+		return nil
+	}
+
+	l = l.withDefaults()
+	var allowed bool
+	switch k := kdf.(type) {
+	case *PBKDF2KDF:
+		allowed = k.Iterations <= l.PBKDF2Iterations
+	case *Argon2idKDF:
+		allowed = k.Time <= l.Argon2idTime && k.Memory <= l.Argon2idMemory && k.Threads <= l.Argon2idThreads
+	case *ScryptKDF:
+		allowed = 128*uint64(k.N)*uint64(k.R) <= uint64(l.ScryptMemory) && k.P <= l.ScryptP
+	default:
+		allowed = true
+	}
+
+	if !allowed {
+		return ErrKDFLimit
+	}
+	return nil
+}
+
+type KDF interface {
+	// DeriveKey derives a keySize bytes long key from the password and salt
+	DeriveKey(password []byte, salt []byte, keySize int) ([]byte, error)
+	// ID identifies the type of KDF
+	ID() byte
+	// Params encodes the parameters needed to reproduce a key, ParseKDF decodes them
+	Params() []byte
+}
+
+/* ParseKDF recreates a KDF from its recorded ID and parameters.
+*  Returns KDF, error
+ */
+func ParseKDF(id byte, params []byte) (KDF, error) {
+	switch id {
+	case KDFNone:
+		if len(params) != 0 {
+			return nil, ErrInvalidKDFParams
+		}
+		return rawKeyKDF{}, nil
+
+	case KDFPBKDF2:
+		if len(params) != 5 {
+			return nil, ErrInvalidKDFParams
+		}
+		hashFunction := hashFunctionFromID(params[4])
+		if hashFunction == nil {
+			return nil, ErrInvalidKDFParams
+		}
+		iterations := binary.BigEndian.Uint32(params)
+		if iterations == 0 || iterations > MaxPBKDF2Iterations {
+			return nil, ErrInvalidKDFParams
+		}
+		return &PBKDF2KDF{Iterations: int(iterations), Hash: hashFunction}, nil
+
+	case KDFArgon2id:
+		if len(params) != 9 {
+			return nil, ErrInvalidKDFParams
+		}
+		k := &Argon2idKDF{
+			Time:    binary.BigEndian.Uint32(params),
+			Memory:  binary.BigEndian.Uint32(params[4:]),
+			Threads: params[8],
+		}
+		if k.Time == 0 || k.Time > MaxArgon2idTime || k.Memory > MaxArgon2idMemory || k.Threads == 0 || k.Threads > MaxArgon2idThreads {
+			return nil, ErrInvalidKDFParams
+		}
+		return k, nil
+
+	case KDFScrypt:
+		if len(params) != 12 {
+			return nil, ErrInvalidKDFParams
+		}
+		n := uint64(binary.BigEndian.Uint32(params))
+		r := uint64(binary.BigEndian.Uint32(params[4:]))
+		p := uint64(binary.BigEndian.Uint32(params[8:]))
+		if n < 2 || n&(n-1) != 0 || r == 0 || 128*n*r > MaxScryptMemory || p == 0 || p > MaxScryptP {
+			return nil, ErrInvalidKDFParams
+		}
+		return &ScryptKDF{N: int(n), R: int(r), P: int(p)}, nil
+
+	default:
+		return nil, ErrUnknownKDF
+	}
+}
+
+// rawKeyKDF is used by NewAESFromKey, it passes the key through as is
+type rawKeyKDF struct{}
+
+func (rawKeyKDF) DeriveKey(key []byte, salt []byte, keySize int) ([]byte, error) {
+	if len(key) != keySize {
+		return nil, ErrInvalidKeySize
+	}
+	return append([]byte{}, key...), nil
+}
+
+func (rawKeyKDF) ID() byte {
+	return KDFNone
+}
+
+func (rawKeyKDF) Params() []byte {
+	return nil
+}
+
+// PBKDF2KDF is the default KDF, with the iterations and hash function given to the Custom constructors
+type PBKDF2KDF struct {
+	Iterations int
+	Hash       func() hash.Hash
+}
+
+func (k *PBKDF2KDF) DeriveKey(password []byte, salt []byte, keySize int) ([]byte, error) {
+	if k.Iterations <= 0 {
+		return nil, ErrInvalidKDFParams
+	}
+	return pbkdf2.Key(password, salt, k.Iterations, keySize, k.Hash), nil
+}
+
+func (k *PBKDF2KDF) ID() byte {
+	return KDFPBKDF2
+}
+
+// Params only records sha1, sha256 and sha512 hash functions, any other hash function can not be parsed back
+func (k *PBKDF2KDF) Params() []byte {
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params, uint32(k.Iterations))
+	params[4] = hashFunctionID(k.Hash)
+
+	return params
+}
+
+// Argon2idKDF is the memory hard argon2id, Memory is in KiB
+type Argon2idKDF struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+/* NewArgon2idKDF uses the parameters recommended by the argon2 package.
+*  Returns Argon2idKDF
+ */
+func NewArgon2idKDF() *Argon2idKDF {
+	return &Argon2idKDF{Time: 1, Memory: 64 * 1024, Threads: 4}
+}
+
+func (k *Argon2idKDF) DeriveKey(password []byte, salt []byte, keySize int) ([]byte, error) {
+	if k.Time == 0 || k.Threads == 0 {
+		return nil, ErrInvalidKDFParams
+	}
+	return argon2.IDKey(password, salt, k.Time, k.Memory, k.Threads, uint32(keySize)), nil
+}
+
+func (k *Argon2idKDF) ID() byte {
+	return KDFArgon2id
+}
+
+func (k *Argon2idKDF) Params() []byte {
+	params := make([]byte, 9)
+	binary.BigEndian.PutUint32(params, k.Time)
+	binary.BigEndian.PutUint32(params[4:], k.Memory)
+	params[8] = k.Threads
+
+	return params
+}
+
+// ScryptKDF is the memory hard scrypt, N must be a power of two
+type ScryptKDF struct {
+	N int
+	R int
+	P int
+}
+
+/* NewScryptKDF uses the parameters recommended by the scrypt package for interactive logins.
+*  Returns ScryptKDF
+ */
+func NewScryptKDF() *ScryptKDF {
+	return &ScryptKDF{N: 32768, R: 8, P: 1}
+}
+
+func (k *ScryptKDF) DeriveKey(password []byte, salt []byte, keySize int) ([]byte, error) {
+	return scrypt.Key(password, salt, k.N, k.R, k.P, keySize)
+}
+
+func (k *ScryptKDF) ID() byte {
+	return KDFScrypt
+}
+
+func (k *ScryptKDF) Params() []byte {
+	params := make([]byte, 12)
+	binary.BigEndian.PutUint32(params, uint32(k.N))
+	binary.BigEndian.PutUint32(params[4:], uint32(k.R))
+	binary.BigEndian.PutUint32(params[8:], uint32(k.P))
+
+	return params
+}
+
+// Hash function IDs, as recorded in the PBKDF2 parameters
+const (
+	hashUnknown = 0
+	hashSHA1    = 1
+	hashSHA256  = 2
+	hashSHA512  = 3
+)
+
+/* hashFunctionID identifies a hash function by its digest of a fixed input, as functions can not be compared.
+*  Returns the hash ID, or hashUnknown
+ */
+func hashFunctionID(hashFunction func() hash.Hash) byte {
+	if hashFunction == nil {
+		return hashUnknown
+	}
+
+	probe := []byte("gocrypt")
+	h := hashFunction()
+	h.Write(probe)
+	digest := h.Sum(nil)
+
+	sha1Digest := sha1.Sum(probe)
+	sha256Digest := sha256.Sum256(probe)
+	sha512Digest := sha512.Sum512(probe)
+
+	switch {
+	case bytes.Equal(digest, sha1Digest[:]):
+		return hashSHA1
+	case bytes.Equal(digest, sha256Digest[:]):
+		return hashSHA256
+	case bytes.Equal(digest, sha512Digest[:]):
+		return hashSHA512
+	default:
+		return hashUnknown
+	}
+}
+
+func hashFunctionFromID(id byte) func() hash.Hash {
+	switch id {
+	case hashSHA1:
+		return sha1.New
+	case hashSHA256:
+		return sha256.New
+	case hashSHA512:
+		return sha512.New
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Key derivation is deliberately slow, so every AES caches the keys it derived, keyed by KDF parameters, salt and key size.
+
+Every writer picks its own random salt, and so gets its own key. The cache saves deriving it again when the stream is read back
+by the same AES, or when several readers open streams written with the same salt. WipeKeyCache forgets all cached keys.
+*/
+
+package gocrypt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+)
+
+// maxCachedKeys bounds the number of derived keys an AES keeps, the oldest key is evicted first
+const maxCachedKeys = 64
+
+type keyCache struct {
+	mutex sync.Mutex
+	keys  map[string][]byte
+	order []string
+}
+
+/* cacheable reports if the KDF parameters fully describe the derived key.
+*  Raw keys are not derived at all, and PBKDF2 with an unrecorded hash function could collide with another hash function.
+ */
+func cacheable(kdf KDF) bool {
+	switch k := kdf.(type) {
+	case rawKeyKDF:
+		return false
+	case *PBKDF2KDF:
+		return hashFunctionID(k.Hash) != hashUnknown
+	default:
+		return true
+	}
+}
+
+func cacheID(kdf KDF, keySize int, salt []byte) string {
+	params := kdf.Params()
+
+	id := make([]byte, 0, 1+4+len(params)+4+len(salt))
+	id = append(id, kdf.ID())
+	id = appendUint32(id, uint32(len(params)))
+	id = append(id, params...)
+	id = appendUint32(id, uint32(keySize))
+
+	return string(append(id, salt...))
+}
+
+func appendUint32(dst []byte, value uint32) []byte {
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], value)
+	return append(dst, encoded[:]...)
+}
+
+/* deriveKey derives a key from the AES password, or returns a copy of a previously derived key.
+*  Returns key, error
+ */
+func (a *AES) deriveKey(kdf KDF, salt []byte, keySize int) ([]byte, error) {
+	if !cacheable(kdf) {
+		return kdf.DeriveKey(a.key, salt, keySize)
+	}
+
+	id := cacheID(kdf, keySize, salt)
+
+	a.cache.mutex.Lock()
+	key, ok := a.cache.keys[id]
+	if ok {
+		key = append([]byte{}, key...)
+	}
+	a.cache.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	//Derived without holding the lock, so cache misses for different keys derive in parallel
+	key, err := kdf.DeriveKey(a.key, salt, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	a.cache.mutex.Lock()
+	defer a.cache.mutex.Unlock()
+
+	//Another caller may have derived the same key meanwhile
+	if _, ok := a.cache.keys[id]; !ok {
+		if a.cache.keys == nil {
+			a.cache.keys = make(map[string][]byte)
+		}
+		if len(a.cache.order) >= maxCachedKeys {
+			evicted := a.cache.order[0]
+			wipe(a.cache.keys[evicted])
+			delete(a.cache.keys, evicted)
+			a.cache.order = a.cache.order[1:]
+		}
+		a.cache.keys[id] = key
+		a.cache.order = append(a.cache.order, id)
+	}
+
+	return append([]byte{}, key...), nil
+}
+
+/* newSalt returns a fresh random salt of saltSize bytes, every writer gets its own.
+*  Returns salt, error
+ */
+func newSalt(saltSize int) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+/* WipeKeyCache zeroes and forgets all derived keys.
+*  Writers and readers created before keep working, the next ones derive their keys again.
+ */
+func (a *AES) WipeKeyCache() {
+	a.cache.mutex.Lock()
+	defer a.cache.mutex.Unlock()
+
+	for _, key := range a.cache.keys {
+		wipe(key)
+	}
+	a.cache.keys = nil
+	a.cache.order = nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
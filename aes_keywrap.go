@@ -0,0 +1,200 @@
+/*
+AES key wrap (RFC 3394) and AES key wrap with padding (RFC 5649), for encrypting data keys under a master key.
+
+The key encryption key is the AES key itself for NewAESFromKey, or a 256 bit key derived from the password
+with a fixed salt (see AES.deterministicKey), so the same password can always unwrap its keys.
+*/
+
+package gocrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrKeyUnwrap is returned when an unwrapped key fails its integrity check, because of a wrong key or modified input
+var ErrKeyUnwrap error = errors.New("key unwrap integrity check failed")
+var ErrInvalidWrapInput error = errors.New("invalid key wrap input size")
+
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+var keyWrapPaddedIV = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+/* WrapKey wraps key with RFC 3394, key must be a multiple of 8 bytes and at least 16 bytes long.
+*  Returns wrapped key, error
+ */
+func (a *AES) WrapKey(key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, ErrInvalidWrapInput
+	}
+
+	block, err := a.keyWrapCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapKey(block, key), nil
+}
+
+/* UnwrapKey unwraps a key wrapped by WrapKey.
+*  Returns key, error
+ */
+func (a *AES) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, ErrInvalidWrapInput
+	}
+
+	block, err := a.keyWrapCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapKey(block, wrapped)
+}
+
+/* WrapKeyWithPadding wraps a key of any non zero length with RFC 5649.
+*  Returns wrapped key, error
+ */
+func (a *AES) WrapKeyWithPadding(key []byte) ([]byte, error) {
+	if len(key) == 0 || uint64(len(key)) > 0xffffffff {
+		return nil, ErrInvalidWrapInput
+	}
+
+	block, err := a.keyWrapCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, 8)
+	copy(iv, keyWrapPaddedIV)
+	binary.BigEndian.PutUint32(iv[4:], uint32(len(key)))
+
+	padded := make([]byte, (len(key)+7)/8*8)
+	copy(padded, key)
+
+	//A single padded block is encrypted directly instead of wrapped
+	if len(padded) == 8 {
+		out := make([]byte, AESBlockSize)
+		block.Encrypt(out, append(iv, padded...))
+		return out, nil
+	}
+
+	return wrap(block, iv, padded), nil
+}
+
+/* UnwrapKeyWithPadding unwraps a key wrapped by WrapKeyWithPadding.
+*  Returns key, error
+ */
+func (a *AES) UnwrapKeyWithPadding(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, ErrInvalidWrapInput
+	}
+
+	block, err := a.keyWrapCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	var iv, padded []byte
+	if len(wrapped) == AESBlockSize {
+		out := make([]byte, AESBlockSize)
+		block.Decrypt(out, wrapped)
+		iv, padded = out[:8], out[8:]
+	} else {
+		iv, padded = unwrap(block, wrapped)
+	}
+
+	//The length is compared as a plain int, ConstantTimeLessOrEq only takes lengths below 2^31
+	length := int64(binary.BigEndian.Uint32(iv[4:]))
+	if subtle.ConstantTimeCompare(iv[:4], keyWrapPaddedIV) != 1 || length > int64(len(padded)) || length <= int64(len(padded))-8 {
+		wipe(padded)
+		return nil, ErrKeyUnwrap
+	}
+
+	if subtle.ConstantTimeCompare(padded[length:], make([]byte, int64(len(padded))-length)) != 1 {
+		wipe(padded)
+		return nil, ErrKeyUnwrap
+	}
+
+	return padded[:length], nil
+}
+
+func (a *AES) keyWrapCipher() (cipher.Block, error) {
+	kek, err := a.deterministicKey("keywrap", KeySize256)
+	if err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(kek)
+}
+
+// wrapKey wraps key under the key encryption key block with RFC 3394
+func wrapKey(block cipher.Block, key []byte) []byte {
+	return wrap(block, keyWrapIV, key)
+}
+
+/* unwrapKey unwraps a key wrapped by wrapKey, checking its integrity.
+*  Returns key, error
+ */
+func unwrapKey(block cipher.Block, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, ErrKeyUnwrap
+	}
+
+	iv, key := unwrap(block, wrapped)
+	if subtle.ConstantTimeCompare(iv, keyWrapIV) != 1 {
+		wipe(key)
+		return nil, ErrKeyUnwrap
+	}
+
+	return key, nil
+}
+
+// wrap is the RFC 3394 wrapping process W, plainText must be a multiple of 8 bytes
+func wrap(block cipher.Block, iv []byte, plainText []byte) []byte {
+	n := len(plainText) / 8
+
+	out := make([]byte, 8+len(plainText))
+	copy(out, iv)
+	copy(out[8:], plainText)
+
+	b := make([]byte, AESBlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[i*8:i*8+8])
+			block.Encrypt(b, b)
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[i*8:i*8+8], b[8:])
+		}
+	}
+
+	return out
+}
+
+/* unwrap is the RFC 3394 unwrapping process W^-1, the caller checks the returned IV.
+*  Returns IV, plaintext
+ */
+func unwrap(block cipher.Block, cipherText []byte) ([]byte, []byte) {
+	n := len(cipherText)/8 - 1
+
+	out := append([]byte{}, cipherText...)
+
+	b := make([]byte, AESBlockSize)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^t)
+			copy(b[8:], out[i*8:i*8+8])
+			block.Decrypt(b, b)
+
+			copy(out[:8], b[:8])
+			copy(out[i*8:i*8+8], b[8:])
+		}
+	}
+
+	return out[:8], out[8:]
+}
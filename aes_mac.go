@@ -0,0 +1,115 @@
+/*
+Encrypt-then-MAC for the CBC and CFB modes, which are not authenticated on their own.
+
+The tag is HMAC(macKey, authenticated header fields | ciphertext), appended to the end of the stream on Close.
+The authenticated header fields (see header.authenticated) include the IV, and are covered whether or not the header is written.
+The MAC key is expanded from the encryption key and the mode with HKDF, so the two keys are never the same,
+and a stream can not be passed off as another mode.
+*/
+
+package gocrypt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrMACUnsupported error = errors.New("mac not supported for this cipher type")
+var ErrStreamStarted error = errors.New("stream already started")
+var ErrNotAuthenticated error = errors.New("stream is not authenticated")
+
+const macKeyInfo = "gocrypt hmac key"
+
+func deriveMACKey(key []byte, hashFunction func() hash.Hash, mode Mode) []byte {
+	macKey := make([]byte, hashFunction().Size())
+	io.ReadFull(hkdf.Expand(hashFunction, key, append([]byte(macKeyInfo), byte(mode))), macKey)
+
+	return macKey
+}
+
+// macWriter passes ciphertext through to downstream, while adding it to the MAC
+type macWriter struct {
+	downstream   io.Writer
+	hashFunction func() hash.Hash
+	mac          hash.Hash
+}
+
+func (m *macWriter) Write(cipherText []byte) (int, error) {
+	m.mac.Write(cipherText)
+	return m.downstream.Write(cipherText)
+}
+
+func (m *macWriter) writeTag() (int, error) {
+	return m.downstream.Write(m.mac.Sum(nil))
+}
+
+/* macReader passes ciphertext through from upstream, while holding back the trailing tag.
+ * Like bytes.Buffer it only returns short reads at the end of the stream, and the end of the stream
+ * is only returned once the tag verifies.
+ */
+type macReader struct {
+	upstream     io.Reader
+	hashFunction func() hash.Hash
+	mac          hash.Hash
+	tagSize      int
+
+	pending  bytes.Buffer
+	scratch  []byte
+	eof      bool
+	verified bool
+	err      error
+}
+
+func newMACReader(upstream io.Reader, hashFunction func() hash.Hash, mac hash.Hash) *macReader {
+	return &macReader{upstream: upstream, hashFunction: hashFunction, mac: mac, tagSize: mac.Size()}
+}
+
+func (m *macReader) Read(dst []byte) (int, error) {
+
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	//Always keep a tags worth of bytes pending, as it is unknown where the stream ends
+	for !m.eof && m.pending.Len() < len(dst)+m.tagSize {
+		m.scratch = scratchBuffer(m.scratch, len(dst)+m.tagSize-m.pending.Len())
+		read, err := m.upstream.Read(m.scratch)
+		m.pending.Write(m.scratch[:read])
+		if err == io.EOF {
+			m.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if !m.eof {
+		cipherText := m.pending.Next(len(dst))
+		m.mac.Write(cipherText)
+		return copy(dst, cipherText), nil
+	}
+
+	if !m.verified {
+		if m.pending.Len() < m.tagSize {
+			m.err = ErrAuthentication
+			return 0, m.err
+		}
+
+		cipherText := m.pending.Bytes()
+		cipherText, tag := cipherText[:len(cipherText)-m.tagSize], cipherText[len(cipherText)-m.tagSize:]
+		m.mac.Write(cipherText)
+		if !hmac.Equal(m.mac.Sum(nil), tag) {
+			m.err = ErrAuthentication
+			return 0, m.err
+		}
+
+		m.pending.Truncate(len(cipherText))
+		m.verified = true
+	}
+
+	return m.pending.Read(dst)
+}
@@ -0,0 +1,35 @@
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) New192OFBWriterCustom(downstream io.Writer, keyIterations int, KeySize int, hashFunction func() hash.Hash, saltSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:     ModeOFB,
+		KeySize:  KeySize,
+		KDF:      a.keyDerivation(keyIterations, hashFunction),
+		SaltSize: saltSize,
+		NoSalt:   saltSize == 0,
+	})
+}
+
+func (a *AES) New192OFBWriter(downstream io.Writer) (*AESWriter, error) {
+	return a.New192OFBWriterCustom(downstream, 4096, KeySize192, sha512.New, DefaultSaltSize)
+}
+
+func (a *AES) New192OFBReaderCustom(upstream io.Reader, iv []byte, salt []byte, keyIterations int, KeySize int, hashFunction func() hash.Hash) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:    ModeOFB,
+		KeySize: KeySize,
+		KDF:     a.keyDerivation(keyIterations, hashFunction),
+		IV:      iv,
+		Salt:    salt,
+	})
+}
+
+func (a *AES) New192OFBReader(upstream io.Reader, iv []byte, salt []byte) (*AESReader, error) {
+	return a.New192OFBReaderCustom(upstream, iv, salt, 4096, KeySize192, sha512.New)
+}
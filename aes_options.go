@@ -0,0 +1,249 @@
+/*
+NewWriterWithOptions and NewReaderWithOptions build every mode, key size and option combination from a Config.
+The New<Size><Mode><Writer|Reader> constructors are shorthands for them.
+*/
+
+package gocrypt
+
+import (
+	"crypto/cipher"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var ErrInvalidChunkSize error = errors.New("invalid chunk size")
+var ErrInvalidIVSize error = errors.New("invalid IV size")
+
+type Mode byte
+
+// Modes, also recorded in the container header
+const (
+	ModeCBC Mode = 1
+	ModeCFB Mode = 2
+	ModeGCM Mode = 3
+	ModeCTR Mode = 4
+	ModeOFB Mode = 5
+	// ModeGCMSIV is AES-GCM-SIV, only with 128 and 256 bit keys.
+	// Unlike the other modes it allocates once per chunk in the steady state, for the key schedule of the chunks derived key
+	ModeGCMSIV Mode = 6
+	// ModeXChaCha20Poly1305 is not AES at all, for targets without AES hardware support. Only with 256 bit keys
+	ModeXChaCha20Poly1305 Mode = 7
+)
+
+// The KDF used when neither the Config nor the AES specify one
+const defaultKeyIterations = 4096
+
+var defaultHashFunction = sha512.New
+
+type Config struct {
+	Mode    Mode
+	KeySize int // KeySize128, KeySize192 or KeySize256, 0 uses KeySize256
+
+	KDF      KDF  // nil uses the KDF the AES was created with, or PBKDF2 with 4096 iterations of SHA-512
+	SaltSize int  // Writers only, 0 uses DefaultSaltSize
+	NoSalt   bool // Writers only, derives the key without a salt
+
+	ChunkSize int // GCM, GCM-SIV and XChaCha20-Poly1305 only, 0 uses the default. Readers take it as the largest chunk size they accept
+	Workers   int // GCM, GCM-SIV and XChaCha20-Poly1305 only, seals or opens up to this many chunks in parallel, see aes_parallel.go. 0 or 1 uses the calling goroutine. Above 1, every chunk allocates its own buffers
+
+	Header   bool             // Writers write a container header, readers read the stream description from one instead of the Config, see OpenReader
+	Envelope bool             // Writers only, encrypts under a random data key wrapped in the container header, see aes_envelope.go. Implies Header
+	MAC      func() hash.Hash // CBC, CFB, CTR and OFB only, enables encrypt-then-MAC with HMAC of this hash function, nil disables it
+
+	IV         []byte // Readers only, the IV returned by the writer
+	Salt       []byte // Readers only, the salt returned by the writer
+	WrappedKey []byte // Readers only, the wrapped data key returned by an envelope writer
+
+	RequireAuthentication bool      // Readers only, fails with ErrNotAuthenticated unless the stream has a MAC or uses an AEAD mode
+	KDFLimits             KDFLimits // Readers with Header only, the costliest KDF the header may name other than the configured one, zero fields use the defaults
+}
+
+func (a *AES) configKDF(config *Config) KDF {
+	if config.KDF != nil {
+		return config.KDF
+	}
+	return a.keyDerivation(defaultKeyIterations, defaultHashFunction)
+}
+
+func configKeySize(config *Config) int {
+	if config.KeySize == 0 {
+		return KeySize256
+	}
+	return config.KeySize
+}
+
+/* NewWriterWithOptions creates a writer for the mode, key size and options in config.
+*  Returns AESWriter, error
+ */
+func (a *AES) NewWriterWithOptions(downstream io.Writer, config Config) (*AESWriter, error) {
+
+	saltSize := config.SaltSize
+	if config.NoSalt {
+		saltSize = 0
+	} else if saltSize == 0 {
+		saltSize = DefaultSaltSize
+	}
+
+	aw, err := a.newAESWriter(a.configKDF(&config), configKeySize(&config), saltSize)
+	if err != nil {
+		return nil, err
+	}
+	aw.downstream = downstream
+	aw.mode = config.Mode
+
+	if config.Envelope {
+		err = aw.useDataKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.Mode {
+	case ModeCBC:
+		aw.blockMode = cipher.NewCBCEncrypter(aw.block, aw.iv)
+		aw.cipherType = blockCipherType
+	case ModeCFB:
+		aw.stream = cipher.NewCFBEncrypter(aw.block, aw.iv)
+		aw.cipherType = streamCipherType
+	case ModeCTR:
+		aw.stream = cipher.NewCTR(aw.block, aw.iv)
+		aw.cipherType = streamCipherType
+	case ModeOFB:
+		aw.stream = cipher.NewOFB(aw.block, aw.iv)
+		aw.cipherType = streamCipherType
+	case ModeGCM, ModeGCMSIV, ModeXChaCha20Poly1305:
+		aw.aead, err = newAEAD(config.Mode, aw.block, aw.key)
+		if err != nil {
+			return nil, err
+		}
+		aw.cipherType = authenticatedCipherType
+
+		aw.chunkSize = config.ChunkSize
+		if aw.chunkSize == 0 {
+			aw.chunkSize = defaultChunkSize
+		}
+		if aw.chunkSize < 0 || aw.chunkSize > maxChunkSize {
+			return nil, ErrInvalidChunkSize
+		}
+		aw.workers = config.Workers
+	default:
+		return nil, ErrUnknownCipherType
+	}
+
+	if config.Header || config.Envelope {
+		err = aw.EnableHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.MAC != nil {
+		err = aw.EnableMAC(config.MAC)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return aw, nil
+}
+
+/* NewReaderWithOptions creates a reader for the mode, key size and options in config, which must match the writers.
+*  With config.Header set, the mode, key size, KDF, MAC, IV, salt and wrapped key are read from the container header instead.
+*  Returns AESReader, error
+ */
+func (a *AES) NewReaderWithOptions(upstream io.Reader, config Config) (*AESReader, error) {
+
+	if config.Header {
+		h, err := readHeader(upstream)
+		if err != nil {
+			return nil, err
+		}
+		err = config.KDFLimits.check(h.kdf, a.configKDF(&config))
+		if err != nil {
+			return nil, err
+		}
+		config = h.apply(config)
+	}
+
+	switch config.Mode {
+	case ModeCBC, ModeCFB, ModeCTR, ModeOFB:
+		if len(config.IV) != AESBlockSize {
+			return nil, ErrInvalidIVSize
+		}
+	}
+
+	ar, err := a.newAESReader(config.IV, config.Salt, a.configKDF(&config), configKeySize(&config))
+	if err != nil {
+		return nil, err
+	}
+	ar.upstream = upstream
+	ar.mode = config.Mode
+
+	if config.WrappedKey != nil {
+		err = ar.openDataKey(config.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.Mode {
+	case ModeCBC:
+		ar.blockMode = cipher.NewCBCDecrypter(ar.block, ar.iv)
+		ar.cipherType = blockCipherType
+	case ModeCFB:
+		ar.stream = cipher.NewCFBDecrypter(ar.block, ar.iv)
+		ar.cipherType = streamCipherType
+	case ModeCTR:
+		ar.stream = cipher.NewCTR(ar.block, ar.iv)
+		ar.cipherType = streamCipherType
+	case ModeOFB:
+		ar.stream = cipher.NewOFB(ar.block, ar.iv)
+		ar.cipherType = streamCipherType
+	case ModeGCM, ModeGCMSIV, ModeXChaCha20Poly1305:
+		ar.aead, err = newAEAD(config.Mode, ar.block, ar.key)
+		if err != nil {
+			return nil, err
+		}
+		ar.cipherType = authenticatedCipherType
+
+		ar.chunkSize = config.ChunkSize
+		if ar.chunkSize == 0 {
+			ar.chunkSize = maxChunkSize
+		}
+		ar.workers = config.Workers
+	default:
+		return nil, ErrUnknownCipherType
+	}
+
+	if config.MAC != nil {
+		err = ar.EnableMAC(config.MAC)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.RequireAuthentication && ar.cipherType != authenticatedCipherType && ar.mac == nil {
+		return nil, ErrNotAuthenticated
+	}
+
+	return ar, nil
+}
+
+// newAEAD creates the AEAD the chunked modes seal their chunks with
+func newAEAD(mode Mode, block cipher.Block, key []byte) (cipher.AEAD, error) {
+	switch mode {
+	case ModeGCM:
+		return cipher.NewGCM(block)
+	case ModeGCMSIV:
+		return newGCMSIV(key)
+	case ModeXChaCha20Poly1305:
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, ErrInvalidKeySize
+		}
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, ErrUnknownCipherType
+	}
+}
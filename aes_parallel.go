@@ -0,0 +1,208 @@
+/*
+With Config.Workers above 1, chunked writers seal chunks on their own goroutines while the caller keeps writing.
+Chunk counters are assigned in order when a chunk is queued, and sealed chunks are written downstream in the same order,
+so the stream is exactly what a sequential writer would have written. At most Workers chunks are in flight at a time,
+a Write that would queue more first waits for the oldest one and writes it.
+
+Chunked readers read ahead the same way, reading up to Workers chunks from upstream and opening them on their own goroutines.
+Plaintext is only released in stream order, so nothing after the first chunk failing authentication is ever returned.
+
+Chunks in flight can not share the scratch buffers of a sequential stream, so unlike it every chunk allocates its own
+buffers and goroutine.
+*/
+
+package gocrypt
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// sealJob is a chunk being sealed on its own goroutine, frame holds the length prefix and ciphertext once done is closed
+type sealJob struct {
+	frame []byte
+	done  chan struct{}
+}
+
+/* queueChunks queues every full chunk in the buffer for sealing, writing the oldest sealed chunks downstream to stay within aw.workers.
+*  Returns written, error
+ */
+func (aw *AESWriter) queueChunks() (written int, err error) {
+	if !aw.headerWritten {
+		written, err = aw.writeChunkedHeader()
+		if err != nil {
+			return written, err
+		}
+	}
+
+	for aw.buffer.Len() >= aw.chunkSize {
+		if len(aw.pending) >= aw.workers {
+			written, err = aw.writePending(1)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		aw.queueChunk(aw.buffer.Next(aw.chunkSize))
+	}
+
+	return written, nil
+}
+
+// queueChunk starts sealing a non final chunk with the next chunk nonce
+func (aw *AESWriter) queueChunk(plainText []byte) {
+	nonce := make([]byte, aw.aead.NonceSize())
+	chunkNonce(nonce, aw.baseNonce, aw.counter)
+	aw.counter++
+
+	//The buffer reuses its memory on the next Write
+	plainText = append([]byte{}, plainText...)
+
+	job := &sealJob{done: make(chan struct{})}
+	aw.pending = append(aw.pending, job)
+
+	go func() {
+		defer close(job.done)
+
+		frame := make([]byte, chunkLengthSize, chunkLengthSize+len(plainText)+aw.aead.Overhead())
+		frame = aw.aead.Seal(frame, nonce, plainText, aw.chunkData.additionalData(false))
+		binary.BigEndian.PutUint32(frame, marshalChunkLength(len(frame)-chunkLengthSize, false))
+		job.frame = frame
+	}()
+}
+
+/* writePending waits for the oldest count queued chunks, or all of them if count is below 0, and writes them downstream in order.
+*  Returns written, error
+ */
+func (aw *AESWriter) writePending(count int) (written int, err error) {
+	if count < 0 || count > len(aw.pending) {
+		count = len(aw.pending)
+	}
+
+	for ; count > 0; count-- {
+		job := aw.pending[0]
+		aw.pending[0] = nil
+		aw.pending = aw.pending[1:]
+
+		<-job.done
+		written, err = aw.downstream.Write(job.frame)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+/* openJob is a chunk being opened on its own goroutine, plainText or err are set once done is closed.
+*  Framing errors found while reading ahead are queued as jobs that are already done, so they surface in stream order.
+ */
+type openJob struct {
+	plainText []byte
+	err       error
+	final     bool
+	done      chan struct{}
+}
+
+/* readChunkParallel reads ahead up to r.workers chunks, opening them on their own goroutines, and buffers the oldest one.
+*  The first chunk that fails, in stream order, ends the stream, and every later Read returns its error.
+ */
+func (r *AESReader) readChunkParallel() error {
+	if r.readErr != nil {
+		return r.readErr
+	}
+
+	if !r.headerRead {
+		err := r.readChunkedHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	for len(r.opening) < r.workers && !r.readAheadDone {
+		r.queueOpen()
+	}
+
+	job := r.opening[0]
+	r.opening[0] = nil
+	r.opening = r.opening[1:]
+
+	<-job.done
+	if job.err != nil {
+		r.readErr = job.err
+		r.opening = nil
+		return job.err
+	}
+	if job.final {
+		r.eof = true
+	}
+
+	_, err := r.buffer.Write(job.plainText)
+	return err
+}
+
+// queueOpen reads the next chunk from upstream and starts opening it, or queues the error reading it returned
+func (r *AESReader) queueOpen() {
+	job := &openJob{done: make(chan struct{})}
+	r.opening = append(r.opening, job)
+
+	fail := func(err error) {
+		job.err = err
+		r.readAheadDone = true
+		close(job.done)
+	}
+
+	length := make([]byte, chunkLengthSize)
+	_, err := io.ReadFull(r.upstream, length)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		fail(ErrTruncated)
+		return
+	} else if err != nil {
+		fail(err)
+		return
+	}
+
+	cipherTextSize, final := unmarshalChunkLength(binary.BigEndian.Uint32(length))
+	if cipherTextSize < r.aead.Overhead() || cipherTextSize > r.chunkSize+r.aead.Overhead() {
+		fail(ErrAuthentication)
+		return
+	}
+
+	cipherText := make([]byte, cipherTextSize)
+	_, err = io.ReadFull(r.upstream, cipherText)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		fail(ErrAuthentication)
+		return
+	} else if err != nil {
+		fail(err)
+		return
+	}
+
+	//Anything after the final chunk has been appended to the stream
+	var trailingErr error
+	if final {
+		r.readAheadDone = true
+		read, err := r.upstream.Read(length[:1])
+		if read != 0 {
+			trailingErr = ErrAuthentication
+		} else if err != nil && err != io.EOF {
+			trailingErr = err
+		}
+	}
+
+	nonce := make([]byte, r.aead.NonceSize())
+	chunkNonce(nonce, r.baseNonce, r.counter)
+	r.counter++
+	job.final = final
+
+	go func() {
+		defer close(job.done)
+
+		plainText, err := r.aead.Open(cipherText[:0], nonce, cipherText, r.chunkData.additionalData(final))
+		if err != nil {
+			job.err = ErrAuthentication
+			return
+		}
+		job.plainText, job.err = plainText, trailingErr
+	}()
+}
@@ -3,17 +3,23 @@ package gocrypt
 import (
 	"bytes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
 	"errors"
+	"hash"
 	"io"
 )
 
 var ErrPaddingError error = errors.New("padding error")
+var ErrAuthentication error = errors.New("message authentication failed")
 
 type AESReader struct {
 	upstream io.Reader
 
 	BlockSize int
-	IV        []byte
+	iv        []byte
+	salt      []byte
+	kdf       KDF
 	key       []byte
 
 	buffer bytes.Buffer
@@ -26,8 +32,31 @@ type AESReader struct {
 
 	stream cipher.Stream
 
-	aead      cipher.AEAD
-	chunkSize int
+	aead       cipher.AEAD
+	chunkSize  int
+	baseNonce  []byte
+	counter    uint64
+	headerRead bool
+	chunkData  chunkData
+
+	mac     *macReader
+	started bool
+
+	mode Mode
+
+	wrappedKey []byte
+
+	seekable *seekableUpstream
+
+	workers       int
+	opening       []*openJob
+	readAheadDone bool
+	readErr       error
+
+	//Reused between reads, see scratchBuffer
+	lengthPrefix [chunkLengthSize]byte
+	nonce        []byte
+	scratch      []byte
 }
 
 /* Read() reads from upstream ciphertext, returning plaintext.
@@ -35,6 +64,12 @@ type AESReader struct {
  */
 func (r *AESReader) Read(dst []byte) (int, error) {
 
+	r.started = true
+
+	if r.seekable != nil {
+		return r.readSeekable(dst)
+	}
+
 	//If upstream is already EOF'ed, read directly from buffer
 	if r.eof {
 		return r.buffer.Read(dst)
@@ -43,32 +78,46 @@ func (r *AESReader) Read(dst []byte) (int, error) {
 	switch r.cipherType {
 	case blockCipherType:
 
+		//Enough is buffered, holding back the last block as it may hold the padding
+		if r.buffer.Len() >= len(dst)+AESBlockSize {
+			return r.buffer.Read(dst)
+		}
+
 		//Read to the nearest multiple of block size + 1 block
 		toRead := len(dst)
 
-		cipherText := make([]byte, nearestMultiple(toRead, AESBlockSize))
+		r.scratch = scratchBuffer(r.scratch, nearestMultiple(toRead, AESBlockSize))
+		cipherText := r.scratch
 		read, err := r.upstream.Read(cipherText)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
 		if read != len(cipherText) || err == io.EOF {
 			r.eof = true
-		} else if err != nil {
-			return 0, err
 		}
 
 		if read%AESBlockSize != 0 {
 			return 0, ErrPaddingError
 		}
 
-		plainText := make([]byte, len(cipherText))
-		r.blockMode.CryptBlocks(plainText[:read], cipherText[:read])
+		//Decrypted in place
+		plainText := cipherText[:read]
+		r.blockMode.CryptBlocks(plainText, plainText)
 
 		if r.eof {
 			//Check if this read resulted in not an entire blocks worth of bytes, if so the padding must be at the end of the current buffer and should be removed
 			if read == 0 {
 				rawBytes := r.buffer.Bytes()
+				if !validPadding(rawBytes) {
+					return 0, ErrPaddingError
+				}
 				r.buffer.Truncate(len(rawBytes) - int(rawBytes[len(rawBytes)-1]))
 
 				return r.buffer.Read(dst)
 			}
+			if !validPadding(plainText[:read]) {
+				return 0, ErrPaddingError
+			}
 			plainText = plainText[:read-int(plainText[read-1])]
 		}
 
@@ -79,18 +128,32 @@ func (r *AESReader) Read(dst []byte) (int, error) {
 
 	case streamCipherType:
 
-		cipherText := make([]byte, len(dst))
-		read, err := r.upstream.Read(cipherText)
-		if read != len(cipherText) || err == io.EOF {
+		//Decrypted in place
+		read, err := r.upstream.Read(dst)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if read != len(dst) || err == io.EOF {
 			r.eof = true
-		} else if err != nil {
-			return read, err
 		}
 
-		r.stream.XORKeyStream(dst[:read], cipherText[:read])
+		r.stream.XORKeyStream(dst[:read], dst[:read])
 
 		return read, nil
 
+	case authenticatedCipherType:
+
+		if r.buffer.Len() == 0 {
+			readChunk := r.readChunk
+			if r.workers > 1 {
+				readChunk = r.readChunkParallel
+			}
+			err := readChunk()
+			if err != nil {
+				return 0, err
+			}
+		}
+
 	default:
 		return 0, ErrUnknownCipherType
 	}
@@ -98,6 +161,139 @@ func (r *AESReader) Read(dst []byte) (int, error) {
 	return r.buffer.Read(dst)
 }
 
+/* readChunkedHeader() reads the chunked stream header from upstream, replacing the maximum chunk size with the streams chunk size.
+ */
+func (r *AESReader) readChunkedHeader() error {
+
+	header := make([]byte, chunkedHeaderSize(r.aead.NonceSize()))
+	_, err := io.ReadFull(r.upstream, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidHeader
+	} else if err != nil {
+		return err
+	}
+
+	r.chunkSize, r.baseNonce, err = unmarshalChunkedHeader(header, r.chunkSize)
+	if err != nil {
+		return err
+	}
+	h := r.description()
+	r.chunkData = newChunkData(h.authenticated())
+	r.headerRead = true
+
+	return nil
+}
+
+/* readChunk() reads a single length prefixed chunk from upstream, authenticates and decrypts it into the buffer.
+ * Sets eof after the final chunk, upstream ending before the final chunk returns ErrTruncated.
+ */
+func (r *AESReader) readChunk() error {
+
+	if !r.headerRead {
+		err := r.readChunkedHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	length := r.lengthPrefix[:]
+	_, err := io.ReadFull(r.upstream, length)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	} else if err != nil {
+		return err
+	}
+
+	cipherTextSize, final := unmarshalChunkLength(binary.BigEndian.Uint32(length))
+	if cipherTextSize < r.aead.Overhead() || cipherTextSize > r.chunkSize+r.aead.Overhead() {
+		return ErrAuthentication
+	}
+
+	r.scratch = scratchBuffer(r.scratch, cipherTextSize)
+	cipherText := r.scratch
+	_, err = io.ReadFull(r.upstream, cipherText)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrAuthentication
+	} else if err != nil {
+		return err
+	}
+
+	r.nonce = scratchBuffer(r.nonce, r.aead.NonceSize())
+	chunkNonce(r.nonce, r.baseNonce, r.counter)
+	r.counter++
+
+	//Opened in place, the buffer copies the plaintext
+	plainText, err := r.aead.Open(cipherText[:0], r.nonce, cipherText, r.chunkData.additionalData(final))
+	if err != nil {
+		return ErrAuthentication
+	}
+
+	if final {
+		//Anything after the final chunk has been appended to the stream
+		read, err := r.upstream.Read(length[:1])
+		if read != 0 {
+			return ErrAuthentication
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		r.eof = true
+	}
+
+	_, err = r.buffer.Write(plainText)
+	return err
+}
+
+// validPadding checks the PKCS#7 padding length at the end of plainText, the padding bytes themselves are covered by the MAC if enabled
+func validPadding(plainText []byte) bool {
+	if len(plainText) == 0 {
+		return false
+	}
+	padding := int(plainText[len(plainText)-1])
+	return padding > 0 && padding <= AESBlockSize && padding <= len(plainText)
+}
+
 func nearestMultiple(wanted int, multiple int) int {
 	return (wanted + (multiple-wanted%multiple)%multiple) + wanted
 }
+
+/* EnableMAC() verifies the HMAC tag appended by AESWriter.EnableMAC, using the same hash function.
+ * Must be called before the first Read. Only CBC and CFB readers support it, GCM is already authenticated.
+ * Plaintext is released as it is decrypted, but the final plaintext (and with it the CBC padding) is only released after the tag verifies,
+ * otherwise Read returns ErrAuthentication.
+ */
+func (r *AESReader) EnableMAC(hashFunction func() hash.Hash) error {
+	if r.cipherType == authenticatedCipherType {
+		return ErrMACUnsupported
+	}
+	if r.started || r.mac != nil {
+		return ErrStreamStarted
+	}
+	if r.seekable != nil {
+		return ErrNotSeekable
+	}
+
+	r.mac = newMACReader(r.upstream, hashFunction, hmac.New(hashFunction, deriveMACKey(r.key, hashFunction, r.mode)))
+	h := r.description()
+	r.mac.mac.Write(h.authenticated())
+	r.upstream = r.mac
+
+	return nil
+}
+
+// IV returns the IV the stream is decrypted with, GCM streams have none as their nonces are part of the stream
+func (r *AESReader) IV() []byte {
+	if r.cipherType == authenticatedCipherType {
+		return nil
+	}
+	return r.iv
+}
+
+// Salt returns the salt the key was derived with
+func (r *AESReader) Salt() []byte {
+	return r.salt
+}
+
+// KDF returns the key derivation function the key was derived with
+func (r *AESReader) KDF() KDF {
+	return r.kdf
+}
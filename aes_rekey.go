@@ -0,0 +1,106 @@
+/*
+Rekey moves an envelope stream (see aes_envelope.go) to a new password or key by rewriting only its container header.
+The data key is unwrapped with the old key, wrapped again under the new one with a fresh salt, and the body is copied as is.
+*/
+
+package gocrypt
+
+import (
+	"crypto/aes"
+	"errors"
+	"io"
+	"math"
+)
+
+var ErrNotEnvelope error = errors.New("stream has no wrapped data key")
+
+/* Rekey copies the envelope stream in src to dst, with its data key wrapped under newAES instead of a.
+*  The old key is verified before anything is written, a wrong one returns ErrKeyUnwrap.
+*  A header KDF other than the one a was created with is held to the default KDFLimits.
+*  newAES keeps the KDF it was created with, NewAES uses PBKDF2 with 4096 iterations of SHA-512.
+*  Returns error
+ */
+func (a *AES) Rekey(src io.ReaderAt, dst io.Writer, newAES *AES) error {
+
+	upstream := io.NewSectionReader(src, 0, math.MaxInt64)
+
+	h, err := readHeader(upstream)
+	if err != nil {
+		return err
+	}
+	if h.wrappedKey == nil {
+		return ErrNotEnvelope
+	}
+	err = KDFLimits{}.check(h.kdf, a.keyDerivation(defaultKeyIterations, defaultHashFunction))
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := a.unwrapDataKey(h)
+	if err != nil {
+		return err
+	}
+	defer wipe(dataKey)
+
+	kdf := newAES.keyDerivation(defaultKeyIterations, defaultHashFunction)
+	saltSize := DefaultSaltSize
+	if kdf.ID() == KDFNone {
+		saltSize = 0
+	}
+	salt, err := newSalt(saltSize)
+	if err != nil {
+		return err
+	}
+	kek, err := newAES.deriveKey(kdf, salt, h.keySize)
+	if err != nil {
+		return err
+	}
+	defer wipe(kek)
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return err
+	}
+
+	h.kdf = kdf
+	h.salt = salt
+	h.wrappedKey = wrapKey(block, dataKey)
+
+	encoded, err := h.marshal()
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(encoded)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, upstream)
+	return err
+}
+
+/* unwrapDataKey unwraps the data key of an envelope header with the key derived from the headers KDF and salt.
+*  Returns data key, error
+ */
+func (a *AES) unwrapDataKey(h *header) ([]byte, error) {
+	kek, err := a.deriveKey(h.kdf, h.salt, h.keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kek)
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := unwrapKey(block, h.wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKey) != h.keySize {
+		wipe(dataKey)
+		return nil, ErrKeyUnwrap
+	}
+
+	return dataKey, nil
+}
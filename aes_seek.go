@@ -0,0 +1,324 @@
+/*
+Seekable readers decrypt any range of a CTR or chunked AEAD stream without decrypting what comes before it.
+
+CTR streams are seeked by adding the block index to the IV. Chunked streams have fixed size frames for all chunks but the last,
+so the chunk holding an offset is found directly. The final chunk is authenticated when the reader is created,
+which also authenticates the plaintext size, so a stream cut off at a chunk boundary is detected before any Read.
+*/
+
+package gocrypt
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrNotSeekable error = errors.New("stream is not seekable")
+var ErrInvalidOffset error = errors.New("invalid offset")
+
+type seekableUpstream struct {
+	upstream  io.ReaderAt // The stream body, after any container and chunked header
+	size      int64       // Ciphertext size of the body
+	plainSize int64
+
+	offset int64
+
+	chunkOffset int64 // Offset of the first chunk in upstream
+	lastChunk   int64
+
+	//The last chunk opened by Read, so sequential reads smaller than a chunk open it only once
+	cachedIndex int64
+	cached      []byte
+}
+
+/* NewSeekableReader creates a reader for the stream in upstream, which is size bytes long, that also implements io.Seeker and io.ReaderAt.
+*  Only CTR and the chunked modes (GCM, GCM-SIV and XChaCha20-Poly1305) without a MAC are seekable, others return ErrNotSeekable.
+*  With config.Header set, the stream starts with a container header, see OpenReader.
+*  Returns AESReader, error
+ */
+func (a *AES) NewSeekableReader(upstream io.ReaderAt, size int64, config Config) (*AESReader, error) {
+
+	start := int64(0)
+	if config.Header {
+		headerReader := io.NewSectionReader(upstream, 0, size)
+		h, err := readHeader(headerReader)
+		if err != nil {
+			return nil, err
+		}
+		err = config.KDFLimits.check(h.kdf, a.configKDF(&config))
+		if err != nil {
+			return nil, err
+		}
+		config = h.apply(config)
+		start, _ = headerReader.Seek(0, io.SeekCurrent)
+	}
+
+	switch config.Mode {
+	case ModeCTR, ModeGCM, ModeGCMSIV, ModeXChaCha20Poly1305:
+	default:
+		return nil, ErrNotSeekable
+	}
+	if config.MAC != nil {
+		return nil, ErrNotSeekable
+	}
+
+	body := io.NewSectionReader(upstream, start, size-start)
+	r, err := a.NewReaderWithOptions(body, config)
+	if err != nil {
+		return nil, err
+	}
+	r.seekable = &seekableUpstream{
+		upstream:    body,
+		size:        body.Size(),
+		plainSize:   body.Size(),
+		cachedIndex: -1,
+	}
+
+	if r.cipherType == authenticatedCipherType {
+		err = r.openSeekableChunks()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+/* openSeekableChunks reads the chunked header, computes the plaintext size from the frame sizes and authenticates the final chunk.
+ */
+func (r *AESReader) openSeekableChunks() error {
+	s := r.seekable
+
+	header := make([]byte, chunkedHeaderSize(r.aead.NonceSize()))
+	_, err := s.upstream.ReadAt(header, 0)
+	if err == io.EOF {
+		return ErrInvalidHeader
+	} else if err != nil {
+		return err
+	}
+	r.chunkSize, r.baseNonce, err = unmarshalChunkedHeader(header, r.chunkSize)
+	if err != nil {
+		return err
+	}
+	h := r.description()
+	r.chunkData = newChunkData(h.authenticated())
+	r.headerRead = true
+
+	s.chunkOffset = int64(len(header))
+	chunks := s.size - s.chunkOffset
+	if chunks < int64(chunkLengthSize+r.aead.Overhead()) {
+		return ErrTruncated
+	}
+
+	frame := r.chunkFrameSize()
+	s.lastChunk = (chunks - 1) / frame
+	last := chunks - s.lastChunk*frame
+	if last < int64(chunkLengthSize+r.aead.Overhead()) {
+		return ErrTruncated
+	}
+	s.plainSize = s.lastChunk*int64(r.chunkSize) + last - int64(chunkLengthSize+r.aead.Overhead())
+
+	_, err = r.openChunkAt(s.lastChunk)
+	return err
+}
+
+// chunkFrameSize is the size of every chunk but the last, with its length prefix
+func (r *AESReader) chunkFrameSize() int64 {
+	return int64(chunkLengthSize + r.chunkSize + r.aead.Overhead())
+}
+
+/* openChunkAt reads, authenticates and decrypts the chunk with the given index.
+*  Only the last chunk may, and must, carry the final flag.
+*  Returns plaintext, error
+ */
+func (r *AESReader) openChunkAt(index int64) ([]byte, error) {
+	s := r.seekable
+
+	frameSize := r.chunkFrameSize()
+	offset := s.chunkOffset + index*frameSize
+	if remaining := s.size - offset; remaining < frameSize {
+		frameSize = remaining
+	}
+
+	frame := make([]byte, frameSize)
+	_, err := s.upstream.ReadAt(frame, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	cipherTextSize, final := unmarshalChunkLength(binary.BigEndian.Uint32(frame[:chunkLengthSize]))
+	if final != (index == s.lastChunk) {
+		if index == s.lastChunk {
+			return nil, ErrTruncated
+		}
+		return nil, ErrAuthentication
+	}
+	if int64(cipherTextSize) != frameSize-chunkLengthSize {
+		return nil, ErrAuthentication
+	}
+
+	nonce := make([]byte, r.aead.NonceSize())
+	chunkNonce(nonce, r.baseNonce, uint64(index))
+
+	plainText, err := r.aead.Open(nil, nonce, frame[chunkLengthSize:], r.chunkData.additionalData(final))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+
+	return plainText, nil
+}
+
+/* ReadAt decrypts len(dst) bytes starting at plaintext offset off, as io.ReaderAt.
+*  Safe for concurrent use, but not concurrently with Read or Seek.
+*  Returns read, error
+ */
+func (r *AESReader) ReadAt(dst []byte, off int64) (int, error) {
+	if r.seekable == nil {
+		return 0, ErrNotSeekable
+	}
+	return r.readAt(dst, off, false)
+}
+
+func (r *AESReader) readAt(dst []byte, off int64, cached bool) (int, error) {
+	s := r.seekable
+
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	if off >= s.plainSize {
+		return 0, io.EOF
+	}
+
+	toRead := len(dst)
+	if remaining := s.plainSize - off; remaining < int64(toRead) {
+		toRead = int(remaining)
+	}
+
+	var err error
+	switch r.cipherType {
+	case streamCipherType:
+		err = r.ctrReadAt(dst[:toRead], off)
+	case authenticatedCipherType:
+		err = r.chunkedReadAt(dst[:toRead], off, cached)
+	default:
+		err = ErrNotSeekable
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if toRead < len(dst) {
+		return toRead, io.EOF
+	}
+	return toRead, nil
+}
+
+// ctrReadAt decrypts dst from offset off, starting the keystream at the counter block holding off
+func (r *AESReader) ctrReadAt(dst []byte, off int64) error {
+	read, err := r.seekable.upstream.ReadAt(dst, off)
+	if read < len(dst) {
+		if err == nil || err == io.EOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	counter := make([]byte, AESBlockSize)
+	copy(counter, r.iv)
+	addCounter(counter, uint64(off/AESBlockSize))
+
+	stream := cipher.NewCTR(r.block, counter)
+	skip := make([]byte, off%AESBlockSize)
+	stream.XORKeyStream(skip, skip)
+	stream.XORKeyStream(dst, dst)
+
+	return nil
+}
+
+// addCounter adds n to the big endian counter block, as cipher.NewCTR increments it
+func addCounter(counter []byte, n uint64) {
+	for i := len(counter) - 1; i >= 0 && n != 0; i-- {
+		sum := uint64(counter[i]) + n&0xff
+		counter[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+}
+
+// chunkedReadAt decrypts dst from offset off, opening every chunk it overlaps
+func (r *AESReader) chunkedReadAt(dst []byte, off int64, cached bool) error {
+	s := r.seekable
+
+	for len(dst) > 0 {
+		index := off / int64(r.chunkSize)
+
+		var plainText []byte
+		if cached && s.cachedIndex == index {
+			plainText = s.cached
+		} else {
+			var err error
+			plainText, err = r.openChunkAt(index)
+			if err != nil {
+				return err
+			}
+			if cached {
+				s.cachedIndex, s.cached = index, plainText
+			}
+		}
+
+		copied := copy(dst, plainText[off-index*int64(r.chunkSize):])
+		dst = dst[copied:]
+		off += int64(copied)
+	}
+
+	return nil
+}
+
+// readSeekable is Read for seekable readers, reading from the current offset
+func (r *AESReader) readSeekable(dst []byte) (int, error) {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+
+	read, err := r.readAt(dst, r.seekable.offset, true)
+	r.seekable.offset += int64(read)
+	if err == io.EOF && read > 0 {
+		err = nil
+	}
+	return read, err
+}
+
+/* Seek sets the plaintext offset of the next Read, as io.Seeker. Seeking past the end is allowed, Read then returns io.EOF.
+*  Returns offset, error
+ */
+func (r *AESReader) Seek(offset int64, whence int) (int64, error) {
+	s := r.seekable
+	if s == nil {
+		return 0, ErrNotSeekable
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.plainSize
+	default:
+		return 0, ErrInvalidOffset
+	}
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	s.offset = offset
+	return offset, nil
+}
+
+// Size returns the plaintext size of a seekable stream, or -1 for other streams
+func (r *AESReader) Size() int64 {
+	if r.seekable == nil {
+		return -1
+	}
+	return r.seekable.plainSize
+}
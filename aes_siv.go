@@ -0,0 +1,206 @@
+/*
+AES-SIV (RFC 5297) deterministic authenticated encryption, for small values such as wrapped secrets or deduplicated blobs.
+Sealing the same plaintext with the same key and additional data always gives the same ciphertext,
+which is the synthetic IV (S2V, a CMAC over the additional data and plaintext) followed by the AES-CTR ciphertext.
+
+As the output must be reproducible there is no stream to store a salt in, so password derived keys use a fixed salt,
+see AES.deterministicKey. Prefer NewAESFromKey with a random 32 byte key where possible.
+*/
+
+package gocrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+var ErrTooManyAdditionalData error = errors.New("too many additional data components")
+
+// sivMaxComponents is the largest number of additional data components S2V allows, besides the plaintext
+const sivMaxComponents = 126
+
+// sivDerivedKeySize is the size of the key derived from a password, two AES-256 keys
+const sivDerivedKeySize = 2 * KeySize256
+
+/* SealSIV deterministically encrypts and authenticates plainText, and authenticates the additional data.
+*  Raw keys from NewAESFromKey must be 32 bytes long (AES-SIV-256), password keys use AES-SIV-512.
+*  Returns synthetic IV | ciphertext, error
+ */
+func (a *AES) SealSIV(plainText []byte, additionalData ...[]byte) ([]byte, error) {
+	key, err := a.sivKey()
+	if err != nil {
+		return nil, err
+	}
+	return sivSeal(key, plainText, additionalData)
+}
+
+/* OpenSIV authenticates and decrypts the output of SealSIV, the additional data must be the same as when sealing.
+*  Returns plaintext, error
+ */
+func (a *AES) OpenSIV(cipherText []byte, additionalData ...[]byte) ([]byte, error) {
+	key, err := a.sivKey()
+	if err != nil {
+		return nil, err
+	}
+	return sivOpen(key, cipherText, additionalData)
+}
+
+func (a *AES) sivKey() ([]byte, error) {
+	key, err := a.deterministicKey("siv", sivDerivedKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 2*KeySize128 && len(key) != 2*KeySize192 && len(key) != 2*KeySize256 {
+		return nil, ErrInvalidKeySize
+	}
+	return key, nil
+}
+
+func sivSeal(key []byte, plainText []byte, additionalData [][]byte) ([]byte, error) {
+	if len(additionalData) > sivMaxComponents {
+		return nil, ErrTooManyAdditionalData
+	}
+
+	macBlock, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctrBlock, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	v := s2v(macBlock, additionalData, plainText)
+
+	out := make([]byte, AESBlockSize+len(plainText))
+	copy(out, v[:])
+	sivCTR(ctrBlock, v, out[AESBlockSize:], plainText)
+
+	return out, nil
+}
+
+func sivOpen(key []byte, cipherText []byte, additionalData [][]byte) ([]byte, error) {
+	if len(additionalData) > sivMaxComponents {
+		return nil, ErrTooManyAdditionalData
+	}
+	if len(cipherText) < AESBlockSize {
+		return nil, ErrAuthentication
+	}
+
+	macBlock, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctrBlock, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	var v [AESBlockSize]byte
+	copy(v[:], cipherText)
+
+	plainText := make([]byte, len(cipherText)-AESBlockSize)
+	sivCTR(ctrBlock, v, plainText, cipherText[AESBlockSize:])
+
+	expected := s2v(macBlock, additionalData, plainText)
+	if subtle.ConstantTimeCompare(expected[:], v[:]) != 1 {
+		wipe(plainText)
+		return nil, ErrAuthentication
+	}
+
+	return plainText, nil
+}
+
+// sivCTR is AES-CTR with the synthetic IV as counter, with the 31st and 63rd bit (from the right) cleared
+func sivCTR(block cipher.Block, v [AESBlockSize]byte, dst []byte, src []byte) {
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(block, v[:]).XORKeyStream(dst, src)
+}
+
+// s2v turns the additional data and plaintext into a single synthetic IV
+func s2v(block cipher.Block, additionalData [][]byte, plainText []byte) [AESBlockSize]byte {
+	var zero [AESBlockSize]byte
+	d := cmac(block, zero[:])
+
+	for _, component := range additionalData {
+		d = dbl(d)
+		mac := cmac(block, component)
+		for i := range d {
+			d[i] ^= mac[i]
+		}
+	}
+
+	var t []byte
+	if len(plainText) >= AESBlockSize {
+		t = append([]byte{}, plainText...)
+		end := t[len(t)-AESBlockSize:]
+		for i := range end {
+			end[i] ^= d[i]
+		}
+	} else {
+		d = dbl(d)
+		t = make([]byte, AESBlockSize)
+		copy(t, plainText)
+		t[len(plainText)] = 0x80
+		for i := range t {
+			t[i] ^= d[i]
+		}
+	}
+
+	return cmac(block, t)
+}
+
+// dbl multiplies by x in GF(2^128), as used by CMAC and S2V
+func dbl(in [AESBlockSize]byte) [AESBlockSize]byte {
+	var out [AESBlockSize]byte
+	carry := in[0] >> 7
+	for i := 0; i < AESBlockSize-1; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[AESBlockSize-1] = in[AESBlockSize-1]<<1 ^ (0x87 & -carry)
+	return out
+}
+
+// cmac is AES-CMAC (RFC 4493)
+func cmac(block cipher.Block, message []byte) [AESBlockSize]byte {
+	var l [AESBlockSize]byte
+	block.Encrypt(l[:], l[:])
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	var last [AESBlockSize]byte
+	blocks := (len(message) + AESBlockSize - 1) / AESBlockSize
+	if blocks > 0 && len(message)%AESBlockSize == 0 {
+		copy(last[:], message[len(message)-AESBlockSize:])
+		for i := range last {
+			last[i] ^= k1[i]
+		}
+	} else {
+		if blocks == 0 {
+			blocks = 1
+		}
+		rest := message[(blocks-1)*AESBlockSize:]
+		copy(last[:], rest)
+		last[len(rest)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+
+	var x [AESBlockSize]byte
+	for i := 0; i < blocks-1; i++ {
+		for j := range x {
+			x[j] ^= message[i*AESBlockSize+j]
+		}
+		block.Encrypt(x[:], x[:])
+	}
+	for j := range x {
+		x[j] ^= last[j]
+	}
+	block.Encrypt(x[:], x[:])
+
+	return x
+}
@@ -2,8 +2,15 @@ package gocrypt
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
 	"io"
 	"testing"
+	"time"
 )
 
 func TestNewAES(t *testing.T) {
@@ -20,7 +27,7 @@ func TestAESWriter(t *testing.T) {
 	}
 
 	res := bytes.NewBuffer([]byte{})
-	writer, _, err := aes.NewWriter(res)
+	writer, err := aes.NewWriter(res)
 	if err != nil {
 		t.Error("Failed to create AES Writer", err)
 	}
@@ -37,7 +44,7 @@ func TestAESWriteAndClose(t *testing.T) {
 	}
 
 	res := bytes.NewBuffer([]byte{})
-	writer, _, err := aes.NewWriter(res)
+	writer, err := aes.NewWriter(res)
 	if err != nil {
 		t.Error("Failed to create AES Writer", err)
 	}
@@ -49,8 +56,9 @@ func TestAESWriteAndClose(t *testing.T) {
 	if err != nil {
 		t.Error("Failed to write to AES Writer", err)
 	}
-	if written != 16 {
-		t.Error("Written bytes not 16", written)
+	//The whole plaintext counts as written, even the partial block that is only buffered
+	if written != 17 {
+		t.Error("Written bytes not 17", written)
 	}
 
 	err = writer.Close()
@@ -68,7 +76,7 @@ func TestReadAndClose(t *testing.T) {
 	aes := NewAES([]byte("This is a secret"))
 
 	buf := bytes.NewBuffer([]byte{})
-	aw, iv, err := aes.NewWriter(buf)
+	aw, err := aes.NewWriter(buf)
 	if err != nil {
 		t.Error(err)
 	}
@@ -79,7 +87,7 @@ func TestReadAndClose(t *testing.T) {
 	aw.Close()
 
 	pbuf := make([]byte, 10000)
-	reader, err := aes.NewReader(buf, iv)
+	reader, err := aes.NewReader(buf, aw.IV(), aw.Salt())
 	if err != nil {
 		t.Error(err)
 	}
@@ -93,32 +101,2157 @@ func TestReadAndClose(t *testing.T) {
 	}
 }
 
+func TestSaltPerWriter(t *testing.T) {
+	aes := NewAES([]byte("This is a secret"))
+
+	first, err := aes.New256GCMWriter(bytes.NewBuffer(nil))
+	if err != nil {
+		t.Error(err)
+	}
+	second, err := aes.New256GCMWriter(bytes.NewBuffer(nil))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(first.Salt()) != DefaultSaltSize {
+		t.Error("Salt has the wrong size", len(first.Salt()))
+	}
+	if bytes.Equal(first.Salt(), second.Salt()) || bytes.Equal(first.key, second.key) {
+		t.Error("Writers share a salt or derived key")
+	}
+
+	custom, err := aes.New256CBCWriterCustom(bytes.NewBuffer(nil), 4096, KeySize256, sha512.New, 32)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(custom.Salt()) != 32 {
+		t.Error("Custom salt has the wrong size", len(custom.Salt()))
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	aes := NewAES([]byte("This is a secret"))
+
+	first, err := aes.New256GCMWriter(bytes.NewBuffer(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := aes.New256GCMWriter(bytes.NewBuffer(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.Salt(), second.Salt()) || len(aes.cache.keys) != 2 {
+		t.Error("Writers of the same AES share a salt")
+	}
+
+	//Reading a stream back reuses its writers key
+	reader, err := aes.New256GCMReader(bytes.NewBuffer(nil), first.Salt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reader.key, first.key) || len(aes.cache.keys) != 2 {
+		t.Error("Expected the cached key for the writers salt", len(aes.cache.keys))
+	}
+	_, err = aes.New256GCMReader(bytes.NewBuffer(nil), make([]byte, DefaultSaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aes.cache.keys) != 3 {
+		t.Error("Expected one cached key per salt", len(aes.cache.keys))
+	}
+
+	aes.WipeKeyCache()
+	if len(aes.cache.keys) != 0 {
+		t.Error("Cache not wiped")
+	}
+
+	for i := 0; i < maxCachedKeys+10; i++ {
+		_, err = aes.New256GCMReaderCustom(bytes.NewBuffer(nil), nil, i+1, KeySize256, sha512.New, maxChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(aes.cache.keys) != maxCachedKeys {
+		t.Error("Cache not bounded", len(aes.cache.keys))
+	}
+}
+
+// barrierKDF only returns once parties derivations are running at the same time
+type barrierKDF struct {
+	parties int
+	entered chan struct{}
+}
+
+func (k *barrierKDF) DeriveKey(password []byte, salt []byte, keySize int) ([]byte, error) {
+	k.entered <- struct{}{}
+	for len(k.entered) < k.parties {
+		time.Sleep(time.Millisecond)
+	}
+	return make([]byte, keySize), nil
+}
+
+func (k *barrierKDF) ID() byte {
+	return 200
+}
+
+func (k *barrierKDF) Params() []byte {
+	return nil
+}
+
+func TestKeyCacheParallel(t *testing.T) {
+	aes := NewAES([]byte("This is a secret"))
+	kdf := &barrierKDF{parties: 4, entered: make(chan struct{}, 4)}
+
+	done := make(chan error)
+	for i := 0; i < kdf.parties; i++ {
+		go func(i int) {
+			_, err := aes.deriveKey(kdf, []byte{byte(i)}, KeySize256)
+			done <- err
+		}(i)
+	}
+	for i := 0; i < kdf.parties; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Derivations of different salts do not run in parallel")
+		}
+	}
+	if len(aes.cache.keys) != kdf.parties {
+		t.Error("Expected one cached key per salt", len(aes.cache.keys))
+	}
+}
+
+func TestWrongSalt(t *testing.T) {
+	aes := NewAES([]byte("This is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256GCMWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	writer.Write([]byte("THIS IS A SECRET MESSAGE"))
+	writer.Close()
+
+	reader, err := aes.New256GCMReader(buf, make([]byte, DefaultSaltSize))
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+func TestKDFs(t *testing.T) {
+	kdfs := []KDF{
+		&PBKDF2KDF{Iterations: 1000, Hash: sha256.New},
+		&Argon2idKDF{Time: 1, Memory: 1024, Threads: 1},
+		&ScryptKDF{N: 1024, R: 8, P: 1},
+	}
+
+	for _, kdf := range kdfs {
+		aes := NewAESWithKDF([]byte("this is a secret"), kdf)
+
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.New256GCMWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := []byte("This is a secret message")
+		writer.Write(message)
+		writer.Close()
+
+		//Reproduce the KDF from the recorded parameters
+		parsed, err := ParseKDF(writer.KDF().ID(), writer.KDF().Params())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.Params(), kdf.Params()) {
+			t.Error("Parsed parameters differ", parsed.Params(), kdf.Params())
+		}
+
+		reader, err := NewAESWithKDF([]byte("this is a secret"), parsed).New256GCMReader(buf, writer.Salt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(out, message) {
+			t.Error("Decrypted plaintext does not equal original plaintext", out)
+		}
+	}
+
+	if _, err := ParseKDF(KDFPBKDF2, (&PBKDF2KDF{Iterations: 1000, Hash: sha512.New384}).Params()); err != ErrInvalidKDFParams {
+		t.Error("Unrecorded hash function parsed", err)
+	}
+	if _, err := ParseKDF(255, nil); err != ErrUnknownKDF {
+		t.Error("Unknown KDF parsed", err)
+	}
+
+	//Forged headers must not make the reader derive with unbounded parameters
+	for _, kdf := range []KDF{
+		&PBKDF2KDF{Iterations: 1 << 31, Hash: sha256.New},
+		&Argon2idKDF{Time: 1, Memory: 0xffffffff, Threads: 4},
+		&Argon2idKDF{Time: 0xffffffff, Memory: 64 * 1024, Threads: 4},
+		&ScryptKDF{N: 1 << 30, R: 8, P: 1},
+		&ScryptKDF{N: 1 << 15, R: 0x7fffffff, P: 1},
+		&ScryptKDF{N: 1 << 15, R: 8, P: 0x7fffffff},
+		&ScryptKDF{N: 1000, R: 8, P: 1},
+	} {
+		if _, err := ParseKDF(kdf.ID(), kdf.Params()); err != ErrInvalidKDFParams {
+			t.Error("Parsed out of bounds parameters", kdf, err)
+		}
+	}
+}
+
+func TestKDFLimits(t *testing.T) {
+	password := []byte("this is a secret")
+	costly := &Argon2idKDF{Time: 4, Memory: 1024, Threads: 1}
+	writerAES := NewAESWithKDF(password, costly)
+	message := []byte("This is a secret message")
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := writerAES.NewWriterWithOptions(buf, Config{Mode: ModeGCM, Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(message)
+	writer.Close()
+
+	//A header KDF costlier than the defaults allow is refused before deriving a key
+	if _, err := NewAES(password).OpenReader(bytes.NewReader(buf.Bytes())); err != ErrKDFLimit {
+		t.Error("Expected KDF limit error, got", err)
+	}
+	if _, err := NewAES(password).NewSeekableReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), Config{Header: true}); err != ErrKDFLimit {
+		t.Error("Expected KDF limit error, got", err)
+	}
+
+	//Unless the limits are raised, or it is the KDF the reader was configured with
+	for i, open := range []func() (*AESReader, error){
+		func() (*AESReader, error) {
+			return NewAES(password).NewReaderWithOptions(bytes.NewReader(buf.Bytes()), Config{Header: true, KDFLimits: KDFLimits{Argon2idTime: 4}})
+		},
+		func() (*AESReader, error) {
+			return NewAES(password).NewReaderWithOptions(bytes.NewReader(buf.Bytes()), Config{Header: true, KDF: costly})
+		},
+		func() (*AESReader, error) {
+			return writerAES.OpenReader(bytes.NewReader(buf.Bytes()))
+		},
+	} {
+		reader, err := open()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(out, message) {
+			t.Error(i, "Decrypted plaintext does not equal original plaintext", err)
+		}
+	}
+
+	limits := KDFLimits{}
+	for _, kdf := range []KDF{
+		&PBKDF2KDF{Iterations: 1000000, Hash: sha512.New},
+		&Argon2idKDF{Time: 1, Memory: 1024 * 1024, Threads: 4},
+		&Argon2idKDF{Time: 1, Memory: 1024, Threads: 64},
+		&ScryptKDF{N: 1 << 20, R: 8, P: 1},
+		&ScryptKDF{N: 1 << 10, R: 8, P: 16},
+	} {
+		if err := limits.check(kdf, nil); err != ErrKDFLimit {
+			t.Error("Allowed a costly KDF", kdf, err)
+		}
+	}
+	for _, kdf := range []KDF{&PBKDF2KDF{Iterations: defaultKeyIterations, Hash: sha512.New}, NewArgon2idKDF(), NewScryptKDF()} {
+		if err := limits.check(kdf, nil); err != nil {
+			t.Error("Refused a default KDF", kdf, err)
+		}
+	}
+
+	envelope := bytes.NewBuffer(nil)
+	writer, err = writerAES.NewWriterWithOptions(envelope, Config{Mode: ModeGCM, Envelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	if err := NewAES(password).Rekey(bytes.NewReader(envelope.Bytes()), io.Discard, NewAES(password)); err != ErrKDFLimit {
+		t.Error("Expected KDF limit error, got", err)
+	}
+
+	file, err := writerAES.CreateEncryptedFile(&memFile{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAES(password).OpenEncryptedFile(file.backend); err != ErrKDFLimit {
+		t.Error("Expected KDF limit error, got", err)
+	}
+}
+
+func TestNewAESFromKey(t *testing.T) {
+	if _, err := NewAESFromKey(make([]byte, 20)); err != ErrInvalidKeySize {
+		t.Error("Accepted a 20 byte key", err)
+	}
+
+	key := bytes.Repeat([]byte{0x42}, KeySize256)
+	aes, err := NewAESFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(writer.key, key) {
+		t.Error("Raw key was derived")
+	}
+	if len(writer.Salt()) != 0 {
+		t.Error("Raw key writer generated a salt")
+	}
+	message := []byte("This is a secret message")
+	writer.Write(message)
+	writer.Close()
+
+	reader, err := aes.NewReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+	if _, err := aes.New128CBCWriter(bytes.NewBuffer(nil)); err != ErrInvalidKeySize {
+		t.Error("Used a 256 bit key for AES-128", err)
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := bytes.Repeat([]byte("This is a secret message"), 500)
+
+	newWriters := []func(io.Writer) (*AESWriter, error){
+		aes.New128CBCWriter,
+		aes.New256CBCWriter,
+		aes.New128CFBWriter,
+		aes.New256CTRWriter,
+		aes.New128OFBWriter,
+		aes.New256GCMWriter,
+	}
+
+	for i, newWriter := range newWriters {
+		for _, mac := range []bool{false, true} {
+			buf := bytes.NewBuffer(nil)
+			writer, err := newWriter(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = writer.EnableHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mac && writer.cipherType != authenticatedCipherType {
+				err = writer.EnableMAC(sha512.New)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			writer.Write(message)
+			writer.Close()
+
+			reader, err := aes.OpenReader(buf)
+			if err != nil {
+				t.Fatal(i, err)
+			}
+			out, err := io.ReadAll(reader)
+			if err != nil {
+				t.Error(i, err)
+			}
+			if !bytes.Equal(out, message) {
+				t.Error(i, "Decrypted plaintext does not equal original plaintext")
+			}
+		}
+	}
+
+	if _, err := aes.OpenReader(bytes.NewBufferString("not a header")); err != ErrInvalidHeader {
+		t.Error("Expected invalid header, got", err)
+	}
+}
+
+func TestWriterInterface(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := bytes.Repeat([]byte("This is a secret message"), 5000)
+
+	for _, mode := range []Mode{ModeCBC, ModeCFB, ModeCTR, ModeOFB, ModeGCM, ModeGCMSIV, ModeXChaCha20Poly1305} {
+		buf := bytes.NewBuffer(nil)
+
+		var writer Writer
+		writer, err := aes.NewWriterWithOptions(buf, Config{Mode: mode})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		//io.Copy fails with a short write unless every Write returns the full length, buffered or not
+		if written, err := writer.Write(message[:3]); written != 3 || err != nil {
+			t.Error(mode, "Write returned", written, err)
+		}
+		copied, err := io.Copy(writer, io.LimitReader(bytes.NewReader(message[3:]), int64(len(message)-3)))
+		if err != nil || copied != int64(len(message)-3) {
+			t.Fatal(mode, "io.Copy", copied, err)
+		}
+		writer.Close()
+
+		//A header kept out of band can be put back in front of the stream
+		header := writer.Header()
+		if header == nil {
+			t.Fatal(mode, "No header")
+		}
+
+		var reader Reader
+		reader, err = aes.OpenReader(io.MultiReader(bytes.NewReader(header), buf))
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		if !bytes.Equal(reader.IV(), writer.IV()) || !bytes.Equal(reader.Header(), header) {
+			t.Error(mode, "Reader does not describe the same stream")
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(mode, err)
+		}
+		if !bytes.Equal(out, message) {
+			t.Error(mode, "Decrypted plaintext does not equal original plaintext")
+		}
+	}
+}
+
+func TestOpenReaderModeTampered(t *testing.T) {
+	aes := NewAESWithKDF([]byte("this is a secret"), &Argon2idKDF{Time: 1, Memory: 1024, Threads: 1})
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.EnableHeader()
+	writer.EnableMAC(sha256.New)
+	writer.Write([]byte("This is a secret message"))
+	writer.Close()
+
+	cipherText := buf.Bytes()
+	if cipherText[len(headerMagic)+1] != byte(ModeCBC) {
+		t.Fatal("Mode not recorded")
+	}
+	cipherText[len(headerMagic)+1] = byte(ModeCFB)
+
+	reader, err := aes.OpenReader(bytes.NewReader(cipherText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := bytes.Repeat([]byte("This is a secret message"), 500)
+
+	for _, config := range []Config{
+		{Mode: ModeCBC, Envelope: true, MAC: sha256.New},
+		{Mode: ModeCTR, KeySize: KeySize128, Envelope: true},
+		{Mode: ModeGCM, Envelope: true},
+		{Mode: ModeXChaCha20Poly1305, Envelope: true},
+	} {
+		buffers := make([]*bytes.Buffer, 2)
+		writers := make([]*AESWriter, 2)
+		for i := range writers {
+			buffers[i] = bytes.NewBuffer(nil)
+			writer, err := aes.NewWriterWithOptions(buffers[i], config)
+			if err != nil {
+				t.Fatal(config.Mode, err)
+			}
+			writer.Write(message)
+			writer.Close()
+			writers[i] = writer
+		}
+
+		if bytes.Equal(writers[0].key, writers[1].key) {
+			t.Error(config.Mode, "Writers do not use separate data keys")
+		}
+		if len(writers[0].WrappedKey()) != configKeySize(&config)+8 {
+			t.Error(config.Mode, "Unexpected wrapped key size")
+		}
+		cipherText := append([]byte{}, buffers[0].Bytes()...)
+
+		reader, err := aes.OpenReader(buffers[0])
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		if !bytes.Equal(reader.WrappedKey(), writers[0].WrappedKey()) {
+			t.Error(config.Mode, "Wrapped key not read from the header")
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(config.Mode, err)
+		}
+		if !bytes.Equal(out, message) {
+			t.Error(config.Mode, "Decrypted plaintext does not equal original plaintext")
+		}
+
+		if _, err := NewAES([]byte("wrong secret")).OpenReader(bytes.NewReader(cipherText)); err != ErrKeyUnwrap {
+			t.Error(config.Mode, "Expected unwrap error, got", err)
+		}
+
+		//The wrapped key is the last header field
+		header := writers[0].Header()
+		cipherText[len(header)-1] ^= 0x01
+		if _, err := aes.OpenReader(bytes.NewReader(cipherText)); err != ErrKeyUnwrap {
+			t.Error(config.Mode, "Expected unwrap error, got", err)
+		}
+	}
+
+	//Raw keys wrap the data key directly
+	key, err := NewAESFromKey(bytes.Repeat([]byte{0x42}, KeySize256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	writer, err := key.NewWriterWithOptions(buf, Config{Mode: ModeGCM, Envelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(message)
+	writer.Close()
+	if bytes.Equal(writer.key, key.key) {
+		t.Error("Stream encrypted under the raw key")
+	}
+
+	//Without the header, the wrapped key is given like the salt
+	buf.Next(len(writer.Header()))
+	reader, err := key.NewReaderWithOptions(buf, Config{Mode: ModeGCM, Salt: writer.Salt(), WrappedKey: writer.WrappedKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	oldAES := NewAES([]byte("this is a secret"))
+	newAES := NewAESWithKDF([]byte("this is a new secret"), &ScryptKDF{N: 1024, R: 8, P: 1})
+	rawAES, err := NewAESFromKey(bytes.Repeat([]byte{0x42}, KeySize256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := bytes.Repeat([]byte("This is a secret message"), 500)
+
+	for _, config := range []Config{
+		{Mode: ModeCBC, Envelope: true, MAC: sha256.New},
+		{Mode: ModeGCM, Envelope: true},
+	} {
+		buf := bytes.NewBuffer(nil)
+		writer, err := oldAES.NewWriterWithOptions(buf, config)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		writer.Write(message)
+		writer.Close()
+		cipherText := buf.Bytes()
+		body := cipherText[len(writer.Header()):]
+
+		rekeyed := bytes.NewBuffer(nil)
+		if err := NewAES([]byte("wrong secret")).Rekey(bytes.NewReader(cipherText), rekeyed, newAES); err != ErrKeyUnwrap {
+			t.Error(config.Mode, "Expected unwrap error, got", err)
+		}
+		if rekeyed.Len() != 0 {
+			t.Error(config.Mode, "Output written with the wrong key")
+		}
+
+		for _, target := range []*AES{newAES, rawAES} {
+			rekeyed.Reset()
+			err = oldAES.Rekey(bytes.NewReader(cipherText), rekeyed, target)
+			if err != nil {
+				t.Fatal(config.Mode, err)
+			}
+			if !bytes.HasSuffix(rekeyed.Bytes(), body) {
+				t.Error(config.Mode, "Body not copied untouched")
+			}
+
+			if _, err := oldAES.OpenReader(bytes.NewReader(rekeyed.Bytes())); err == nil {
+				t.Error(config.Mode, "Old key still opens the stream")
+			}
+			reader, err := target.OpenReader(rekeyed)
+			if err != nil {
+				t.Fatal(config.Mode, err)
+			}
+			out, err := io.ReadAll(reader)
+			if err != nil {
+				t.Error(config.Mode, err)
+			}
+			if !bytes.Equal(out, message) {
+				t.Error(config.Mode, "Decrypted plaintext does not equal original plaintext")
+			}
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := oldAES.NewWriterWithOptions(buf, Config{Mode: ModeGCM, Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(message)
+	writer.Close()
+	if err := oldAES.Rekey(bytes.NewReader(buf.Bytes()), io.Discard, newAES); err != ErrNotEnvelope {
+		t.Error("Expected not envelope error, got", err)
+	}
+}
+
+func TestSeekableReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := make([]byte, 10000)
+	for i := range message {
+		message[i] = byte(i * 7)
+	}
+
+	for _, config := range []Config{
+		{Mode: ModeCTR},
+		{Mode: ModeCTR, KeySize: KeySize128, Header: true},
+		{Mode: ModeGCM, ChunkSize: 1000},
+		{Mode: ModeGCM, ChunkSize: 999, Envelope: true},
+		{Mode: ModeXChaCha20Poly1305, ChunkSize: 64, Header: true},
+	} {
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriterWithOptions(buf, config)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		writer.Write(message)
+		writer.Close()
+
+		config.IV = writer.IV()
+		config.Salt = writer.Salt()
+		config.Header = config.Header || config.Envelope
+		cipherText := buf.Bytes()
+
+		reader, err := aes.NewSeekableReader(bytes.NewReader(cipherText), int64(len(cipherText)), config)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		if reader.Size() != int64(len(message)) {
+			t.Error(config.Mode, "Wrong plaintext size", reader.Size())
+		}
+
+		for _, r := range [][2]int{{0, 10}, {15, 17}, {999, 1001}, {1000, 3000}, {4321, 4322}, {9990, 10000}, {0, 10000}} {
+			out := make([]byte, r[1]-r[0])
+			read, err := reader.ReadAt(out, int64(r[0]))
+			if err != nil || read != len(out) {
+				t.Error(config.Mode, r, read, err)
+			}
+			if !bytes.Equal(out, message[r[0]:r[1]]) {
+				t.Error(config.Mode, r, "Decrypted range does not equal original plaintext")
+			}
+		}
+
+		out := make([]byte, 100)
+		if read, err := reader.ReadAt(out, 9950); read != 50 || err != io.EOF {
+			t.Error(config.Mode, "Expected short read at the end, got", read, err)
+		}
+
+		_, err = reader.Seek(-2500, io.SeekEnd)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		out, err = io.ReadAll(reader)
+		if err != nil || !bytes.Equal(out, message[7500:]) {
+			t.Error(config.Mode, "Read after Seek does not equal original plaintext", err)
+		}
+		reader.Seek(0, io.SeekStart)
+		out, err = io.ReadAll(reader)
+		if err != nil || !bytes.Equal(out, message) {
+			t.Error(config.Mode, "Read after Seek does not equal original plaintext", err)
+		}
+		if _, err := reader.Seek(-1, io.SeekStart); err != ErrInvalidOffset {
+			t.Error(config.Mode, "Expected invalid offset, got", err)
+		}
+
+		if config.Mode != ModeCTR {
+			//Cut off after a whole chunk
+			cut := len(cipherText) - (chunkLengthSize + len(message)%config.ChunkSize + 16)
+			if _, err := aes.NewSeekableReader(bytes.NewReader(cipherText), int64(cut), config); err != ErrTruncated {
+				t.Error(config.Mode, "Expected truncated error, got", err)
+			}
+
+			tampered := append([]byte{}, cipherText...)
+			tampered[len(tampered)/2] ^= 0x01
+			reader, err := aes.NewSeekableReader(bytes.NewReader(tampered), int64(len(tampered)), config)
+			if err != nil {
+				t.Fatal(config.Mode, err)
+			}
+			if _, err := io.ReadAll(reader); err != ErrAuthentication {
+				t.Error(config.Mode, "Expected authentication error, got", err)
+			}
+		}
+	}
+
+	if _, err := aes.NewSeekableReader(bytes.NewReader(nil), 0, Config{Mode: ModeCBC}); err != ErrNotSeekable {
+		t.Error("Expected not seekable, got", err)
+	}
+	if _, err := aes.NewSeekableReader(bytes.NewReader(nil), 0, Config{Mode: ModeCTR, MAC: sha256.New}); err != ErrNotSeekable {
+		t.Error("Expected not seekable, got", err)
+	}
+
+	//Seeking the keystream agrees with the CTR increments, also when they carry across bytes
+	block, _ := aes.newAESWriter(&PBKDF2KDF{Iterations: 1, Hash: sha256.New}, KeySize128, 0)
+	iv := bytes.Repeat([]byte{0xff}, AESBlockSize)
+	iv[0] = 0
+	keyStream := make([]byte, 4*AESBlockSize)
+	cipher.NewCTR(block.block, iv).XORKeyStream(keyStream, keyStream)
+
+	addCounter(iv, 3)
+	if hex.EncodeToString(iv) != "01000000000000000000000000000002" {
+		t.Error("Counter did not carry", hex.EncodeToString(iv))
+	}
+	seeked := make([]byte, AESBlockSize)
+	cipher.NewCTR(block.block, iv).XORKeyStream(seeked, seeked)
+	if !bytes.Equal(seeked, keyStream[3*AESBlockSize:]) {
+		t.Error("Seeked keystream does not match")
+	}
+}
+
+// memFile is an in memory FileBackend
+type memFile struct {
+	data []byte
+}
+
+func (m *memFile) ReadAt(dst []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	read := copy(dst, m.data[off:])
+	if read < len(dst) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (m *memFile) WriteAt(src []byte, off int64) (int, error) {
+	if end := off + int64(len(src)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], src), nil
+}
+
+func (m *memFile) Truncate(size int64) error {
+	if size > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	}
+	m.data = m.data[:size]
+	return nil
+}
+
+func TestEncryptedFile(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	backend := &memFile{}
+
+	file, err := aes.CreateEncryptedFile(backend, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Every operation is mirrored on a plaintext model
+	var model []byte
+	check := func(step string) {
+		if file.Size() != int64(len(model)) {
+			t.Fatal(step, "Size", file.Size(), "expected", len(model))
+		}
+		out := make([]byte, len(model)+10)
+		read, err := file.ReadAt(out, 0)
+		if read != len(model) || (err != io.EOF && err != nil) {
+			t.Fatal(step, "ReadAt", read, err)
+		}
+		if !bytes.Equal(out[:read], model) {
+			t.Fatal(step, "Decrypted plaintext does not equal model")
+		}
+	}
+	writeAt := func(src []byte, off int) {
+		if end := off + len(src); end > len(model) {
+			model = append(model, make([]byte, end-len(model))...)
+		}
+		copy(model[off:], src)
+		if _, err := file.WriteAt(src, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check("empty")
+	writeAt(bytes.Repeat([]byte("a"), 250), 0)
+	check("append")
+	writeAt(bytes.Repeat([]byte("b"), 30), 90)
+	check("overwrite across chunks")
+	writeAt(bytes.Repeat([]byte("c"), 5), 420)
+	check("write past the end")
+
+	before := append([]byte{}, backend.data...)
+	writeAt(bytes.Repeat([]byte("d"), 10), 310)
+	check("overwrite one chunk")
+	slot := int64(file.aead.NonceSize() + 100 + file.aead.Overhead())
+	for index := int64(0); index < 5; index++ {
+		start, end := file.slotOffset(index), file.slotOffset(index)+slot
+		if end > int64(len(before)) {
+			end = int64(len(before))
+		}
+		if changed := !bytes.Equal(before[start:end], backend.data[start:end]); changed != (index == 3) {
+			t.Error("Chunk", index, "changed:", changed)
+		}
+	}
+
+	if err := file.Truncate(150); err != nil {
+		t.Fatal(err)
+	}
+	model = model[:150]
+	check("shrink")
+	if int64(len(backend.data)) != file.backendSize(150) {
+		t.Error("Backend not truncated")
+	}
+	if err := file.Truncate(333); err != nil {
+		t.Fatal(err)
+	}
+	model = append(model, make([]byte, 333-150)...)
+	check("grow")
+
+	out := make([]byte, 20)
+	if read, err := file.ReadAt(out, 95); read != 20 || err != nil || !bytes.Equal(out, model[95:115]) {
+		t.Error("ReadAt across chunks", read, err)
+	}
+
+	reopened, err := aes.OpenEncryptedFile(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = reopened
+	check("reopen")
+
+	if _, err := NewAES([]byte("wrong secret")).OpenEncryptedFile(backend); err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+
+	//Cutting off the last chunk is caught by the sealed size
+	backend.data = backend.data[:file.slotOffset(3)]
+	if _, err := file.ReadAt(out, 310); err != ErrTruncated {
+		t.Error("Expected truncated error, got", err)
+	}
+
+	backend.data[file.slotOffset(1)+20] ^= 0x01
+	if _, err := file.ReadAt(out, 120); err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+// eofFile is a memFile that returns io.EOF with every read reaching its end, even a full one, as io.ReaderAt allows
+type eofFile struct {
+	memFile
+}
+
+func (f *eofFile) ReadAt(dst []byte, off int64) (int, error) {
+	read, err := f.memFile.ReadAt(dst, off)
+	if err == nil && off+int64(read) == int64(len(f.data)) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func TestEncryptedFileEOF(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	backend := &eofFile{}
+
+	if _, err := aes.CreateEncryptedFile(backend, 100); err != nil {
+		t.Fatal(err)
+	}
+	file, err := aes.OpenEncryptedFile(backend)
+	if err != nil {
+		t.Fatal("Opening an empty file", err)
+	}
+
+	message := bytes.Repeat([]byte("a"), 150)
+	for _, off := range []int64{0, 150, 280} {
+		if _, err := file.WriteAt(message, off); err != nil {
+			t.Fatal("Writing at", off, err)
+		}
+	}
+	out := make([]byte, 30)
+	if read, err := file.ReadAt(out, file.Size()-30); read != 30 || (err != nil && err != io.EOF) || !bytes.Equal(out, message[:30]) {
+		t.Error("Reading the last chunk", read, err)
+	}
+
+	//A short read is still truncated
+	backend.data = backend.data[:len(backend.data)-1]
+	if _, err := file.ReadAt(out, file.Size()-30); err != ErrTruncated {
+		t.Error("Expected truncated error, got", err)
+	}
+}
+
+func TestEncryptedFileSwap(t *testing.T) {
+	//A raw key, so both files use the same key
+	aes, err := NewAESFromKey(bytes.Repeat([]byte{0x42}, KeySize256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := []*memFile{{}, {}}
+	files := make([]*EncryptedFile, 2)
+	for i, backend := range backends {
+		files[i], err = aes.CreateEncryptedFile(backend, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := files[i].WriteAt(bytes.Repeat([]byte{byte('a' + i)}, 250), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Each file has its own key, even with the same raw key
+	nonce := make([]byte, files[0].aead.NonceSize())
+	sealed := files[0].aead.Seal(nil, nonce, []byte("chunk"), files[0].chunkData(0))
+	if _, err := files[1].aead.Open(nil, nonce, sealed, files[0].chunkData(0)); err == nil {
+		t.Error("Files share a key")
+	}
+
+	//A chunk copied from the other file, at the same index
+	start, end := files[0].slotOffset(1), files[0].slotOffset(2)
+	copy(backends[1].data[start:end], backends[0].data[start:end])
+	if _, err := files[1].ReadAt(make([]byte, 10), 120); err != ErrAuthentication {
+		t.Error("Expected authentication error for a chunk from another file, got", err)
+	}
+
+	//The size record copied from the other file
+	copy(backends[1].data[len(files[1].header):files[1].dataOffset], backends[0].data[len(files[0].header):files[0].dataOffset])
+	if _, err := aes.OpenEncryptedFile(backends[1]); err != ErrAuthentication {
+		t.Error("Expected authentication error for a size from another file, got", err)
+	}
+}
+
+// failingFile is a memFile whose failAt-th write fails
+type failingFile struct {
+	memFile
+	failAt int
+}
+
+func (f *failingFile) WriteAt(src []byte, off int64) (int, error) {
+	f.failAt--
+	if f.failAt == 0 {
+		return 0, io.ErrShortWrite
+	}
+	return f.memFile.WriteAt(src, off)
+}
+
+func TestEncryptedFilePartialWrite(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	backend := &failingFile{}
+
+	file, err := aes.CreateEncryptedFile(backend, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(bytes.Repeat([]byte("a"), 250), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	//Overwriting chunks 0 to 2 from offset 50, only chunk 0 makes it
+	backend.failAt = 2
+	written, err := file.WriteAt(bytes.Repeat([]byte("b"), 200), 50)
+	if err != io.ErrShortWrite || written != 50 {
+		t.Error("Expected 50 bytes written before the error, got", written, err)
+	}
+
+	//Growing the file, chunks 2 and 3 make it and the size is updated to cover them
+	backend.failAt = 3
+	written, err = file.WriteAt(bytes.Repeat([]byte("c"), 200), 250)
+	if err != io.ErrShortWrite || written != 150 || file.Size() != 400 {
+		t.Error("Expected 150 bytes written before the error, got", written, err, file.Size())
+	}
+
+	out := make([]byte, 400)
+	if _, err := file.ReadAt(out, 0); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(append(bytes.Repeat([]byte("a"), 50), bytes.Repeat([]byte("b"), 50)...), bytes.Repeat([]byte("a"), 150)...), bytes.Repeat([]byte("c"), 150)...)
+	if !bytes.Equal(out, expected) {
+		t.Error("Decrypted plaintext does not equal the committed writes")
+	}
+}
+
+func TestParallelWriter(t *testing.T) {
+	//A raw key, so both writers use the same key
+	aes, err := NewAESFromKey(bytes.Repeat([]byte{0x42}, KeySize256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := make([]byte, 100000)
+	for i := range message {
+		message[i] = byte(i * 7)
+	}
+
+	for _, mode := range []Mode{ModeGCM, ModeGCMSIV, ModeXChaCha20Poly1305} {
+		parallelBuf := bytes.NewBuffer(nil)
+		parallel, err := aes.NewWriterWithOptions(parallelBuf, Config{Mode: mode, ChunkSize: 1000, Workers: 4})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+
+		//Same base nonce as the parallel writer
+		sequentialBuf := bytes.NewBuffer(nil)
+		sequential, err := aes.NewWriterWithOptions(sequentialBuf, Config{Mode: mode, ChunkSize: 1000})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+
+		for i := 0; i < len(message); i += 777 {
+			end := i + 777
+			if end > len(message) {
+				end = len(message)
+			}
+			if _, err := parallel.Write(message[i:end]); err != nil {
+				t.Fatal(mode, err)
+			}
+			if len(parallel.pending) > 4 {
+				t.Fatal(mode, "More chunks in flight than workers")
+			}
+			if i == 0 {
+				sequential.baseNonce = parallel.baseNonce
+				sequential.headerWritten = true
+				sequential.chunkData = parallel.chunkData
+				sequentialBuf.Write(marshalChunkedHeader(1000, parallel.baseNonce))
+			}
+			sequential.Write(message[i:end])
+		}
+		if err := parallel.Close(); err != nil {
+			t.Fatal(mode, err)
+		}
+		sequential.Close()
+
+		if !bytes.Equal(parallelBuf.Bytes(), sequentialBuf.Bytes()) {
+			t.Error(mode, "Parallel stream differs from sequential stream")
+		}
+
+		reader, err := aes.NewReaderWithOptions(parallelBuf, Config{Mode: mode, Salt: parallel.Salt()})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(out, message) {
+			t.Error(mode, "Decrypted plaintext does not equal original plaintext", err)
+		}
+
+		//io.Copy fails with a short write unless Write returns the full length
+		copyBuf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriterWithOptions(copyBuf, Config{Mode: mode, ChunkSize: 1000, Workers: 4})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		copied, err := io.Copy(writer, io.LimitReader(bytes.NewReader(message), int64(len(message))))
+		if err != nil || copied != int64(len(message)) {
+			t.Fatal(mode, "io.Copy", copied, err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(mode, err)
+		}
+		reader, err = aes.NewReaderWithOptions(copyBuf, Config{Mode: mode, Salt: writer.Salt()})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		out, err = io.ReadAll(reader)
+		if err != nil || !bytes.Equal(out, message) {
+			t.Error(mode, "Decrypted plaintext does not equal original plaintext", err)
+		}
+	}
+}
+
+func TestParallelReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := make([]byte, 100000)
+	for i := range message {
+		message[i] = byte(i * 7)
+	}
+
+	for _, mode := range []Mode{ModeGCM, ModeGCMSIV, ModeXChaCha20Poly1305} {
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriterWithOptions(buf, Config{Mode: mode, ChunkSize: 1000, Workers: 3})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		writer.Write(message)
+		writer.Close()
+		cipherText := buf.Bytes()
+
+		read := func(cipherText []byte) ([]byte, error) {
+			reader, err := aes.NewReaderWithOptions(bytes.NewReader(cipherText), Config{Mode: mode, Salt: writer.Salt(), Workers: 8})
+			if err != nil {
+				t.Fatal(mode, err)
+			}
+			out, err := io.ReadAll(reader)
+			if err != nil {
+				//Failures are sticky
+				if _, again := reader.Read(make([]byte, 10)); again != err {
+					t.Error(mode, "Error not repeated", again)
+				}
+			}
+			return out, err
+		}
+
+		out, err := read(cipherText)
+		if err != nil || !bytes.Equal(out, message) {
+			t.Error(mode, "Decrypted plaintext does not equal original plaintext", err)
+		}
+
+		//Only the plaintext in front of the first tampered chunk is released, however many chunks are opened ahead
+		frame := chunkLengthSize + 1000 + writer.aead.Overhead()
+		headerSize := chunkedHeaderSize(writer.aead.NonceSize())
+		tampered := append([]byte{}, cipherText...)
+		tampered[headerSize+frame*40+10] ^= 0x01
+		tampered[headerSize+frame*42+10] ^= 0x01
+		out, err = read(tampered)
+		if err != ErrAuthentication || !bytes.Equal(out, message[:40000]) {
+			t.Error(mode, "Expected authentication error after 40 chunks, got", len(out), err)
+		}
+
+		out, err = read(cipherText[:headerSize+frame*50])
+		if err != ErrTruncated || !bytes.Equal(out, message[:50000]) {
+			t.Error(mode, "Expected truncated error after 50 chunks, got", len(out), err)
+		}
+
+		out, err = read(append(append([]byte{}, cipherText...), 0))
+		if err != ErrAuthentication || !bytes.Equal(out, message[:len(message)/1000*1000]) {
+			t.Error(mode, "Expected authentication error before the final chunk, got", len(out), err)
+		}
+	}
+}
+
+var steadyStateConfigs = []Config{
+	{Mode: ModeCBC},
+	{Mode: ModeCBC, MAC: sha256.New},
+	{Mode: ModeCFB},
+	{Mode: ModeCTR, MAC: sha512.New},
+	{Mode: ModeOFB},
+	{Mode: ModeGCM},
+	{Mode: ModeGCMSIV},
+	{Mode: ModeXChaCha20Poly1305},
+}
+
+func TestSteadyStateAllocs(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := make([]byte, 4096)
+
+	for _, config := range steadyStateConfigs {
+		//GCM-SIV derives a key per chunk, which allocates its key schedule, as documented on ModeGCMSIV
+		var expected float64
+		if config.Mode == ModeGCMSIV {
+			expected = 1
+		}
+
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriterWithOptions(buf, config)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		for i := 0; i < 300; i++ {
+			writer.Write(message)
+		}
+		writer.Close()
+		config.IV = writer.IV()
+		config.Salt = writer.Salt()
+
+		writer, err = aes.NewWriterWithOptions(io.Discard, config)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		writer.Write(message)
+		if allocs := testing.AllocsPerRun(100, func() { writer.Write(message) }); allocs != expected {
+			t.Error(config.Mode, "Write allocates", allocs)
+		}
+
+		reader, err := aes.NewReaderWithOptions(buf, config)
+		if err != nil {
+			t.Fatal(config.Mode, err)
+		}
+		reader.Read(message)
+		reader.Read(message)
+		if allocs := testing.AllocsPerRun(100, func() {
+			if _, err := reader.Read(message); err != nil {
+				t.Fatal(config.Mode, err)
+			}
+		}); allocs != expected {
+			t.Error(config.Mode, "Read allocates", allocs)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, config Config) {
+	aes := NewAES([]byte("this is a secret"))
+	message := make([]byte, 4096)
+
+	writer, err := aes.NewWriterWithOptions(io.Discard, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.Write(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkRead(b *testing.B, config Config) {
+	aes := NewAES([]byte("this is a secret"))
+	message := make([]byte, 4096)
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.NewWriterWithOptions(buf, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1024; i++ {
+		writer.Write(message)
+	}
+	writer.Close()
+	config.IV = writer.IV()
+	config.Salt = writer.Salt()
+
+	newReader := func() *AESReader {
+		reader, err := aes.NewReaderWithOptions(bytes.NewReader(buf.Bytes()), config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return reader
+	}
+	reader := newReader()
+
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := reader.Read(message)
+		if err == io.EOF {
+			//Starting over is not part of the steady state
+			b.StopTimer()
+			reader = newReader()
+			b.StartTimer()
+		} else if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteCBC(b *testing.B)     { benchmarkWrite(b, steadyStateConfigs[0]) }
+func BenchmarkWriteCBCMAC(b *testing.B)  { benchmarkWrite(b, steadyStateConfigs[1]) }
+func BenchmarkWriteCFB(b *testing.B)     { benchmarkWrite(b, steadyStateConfigs[2]) }
+func BenchmarkWriteCTRMAC(b *testing.B)  { benchmarkWrite(b, steadyStateConfigs[3]) }
+func BenchmarkWriteOFB(b *testing.B)     { benchmarkWrite(b, steadyStateConfigs[4]) }
+func BenchmarkWriteGCM(b *testing.B)     { benchmarkWrite(b, steadyStateConfigs[5]) }
+func BenchmarkWriteGCMSIV(b *testing.B)  { benchmarkWrite(b, steadyStateConfigs[6]) }
+func BenchmarkWriteXChaCha(b *testing.B) { benchmarkWrite(b, steadyStateConfigs[7]) }
+
+func BenchmarkReadCBC(b *testing.B)     { benchmarkRead(b, steadyStateConfigs[0]) }
+func BenchmarkReadCBCMAC(b *testing.B)  { benchmarkRead(b, steadyStateConfigs[1]) }
+func BenchmarkReadCFB(b *testing.B)     { benchmarkRead(b, steadyStateConfigs[2]) }
+func BenchmarkReadCTRMAC(b *testing.B)  { benchmarkRead(b, steadyStateConfigs[3]) }
+func BenchmarkReadOFB(b *testing.B)     { benchmarkRead(b, steadyStateConfigs[4]) }
+func BenchmarkReadGCM(b *testing.B)     { benchmarkRead(b, steadyStateConfigs[5]) }
+func BenchmarkReadGCMSIV(b *testing.B)  { benchmarkRead(b, steadyStateConfigs[6]) }
+func BenchmarkReadXChaCha(b *testing.B) { benchmarkRead(b, steadyStateConfigs[7]) }
+
+var parallelConfig = Config{Mode: ModeGCM, ChunkSize: 16 * 1024, Workers: 4}
+
+func BenchmarkWriteGCMParallel(b *testing.B) { benchmarkWrite(b, parallelConfig) }
+func BenchmarkReadGCMParallel(b *testing.B)  { benchmarkRead(b, parallelConfig) }
+
+func TestHeaderAuthenticated(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := []byte("This is a secret message")
+
+	write := func(mode Mode) ([]byte, int) {
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriterWithOptions(buf, Config{Mode: mode, Header: true, MAC: sha256.New})
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		writer.Write(message)
+		writer.Close()
+		return buf.Bytes(), len(writer.Header())
+	}
+	read := func(cipherText []byte, config Config) ([]byte, error) {
+		config.Header = true
+		reader, err := aes.NewReaderWithOptions(bytes.NewReader(cipherText), config)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(reader)
+	}
+
+	for _, mode := range []Mode{ModeCBC, ModeCFB} {
+		cipherText, headerSize := write(mode)
+
+		//The MAC hash ID is the last field, the IV comes before it
+		tampered := append([]byte{}, cipherText...)
+		tampered[headerSize-1] = hashFunctionID(sha512.New)
+		if _, err := read(tampered, Config{}); err != ErrAuthentication {
+			t.Error(mode, "Expected authentication error for a changed MAC hash, got", err)
+		}
+
+		tampered = append([]byte{}, cipherText...)
+		tampered[headerSize-2] ^= 0x01
+		if _, err := read(tampered, Config{}); err != ErrAuthentication {
+			t.Error(mode, "Expected authentication error for a changed IV, got", err)
+		}
+
+		//Stripping the MAC is only caught by readers that require authentication
+		tampered = append([]byte{}, cipherText...)
+		tampered[headerSize-1] = hashUnknown
+		if _, err := aes.OpenAuthenticatedReader(bytes.NewReader(tampered)); err != ErrNotAuthenticated {
+			t.Error(mode, "Expected not authenticated error, got", err)
+		}
+
+		out, err := read(cipherText, Config{RequireAuthentication: true})
+		if err != nil || !bytes.Equal(out, message) {
+			t.Error(mode, "Decrypted plaintext does not equal original plaintext", err)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.NewWriterWithOptions(buf, Config{Mode: ModeGCM, Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(message)
+	writer.Close()
+	out, err := read(buf.Bytes(), Config{RequireAuthentication: true})
+	if err != nil || !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", err)
+	}
+
+	//The chunks associated data covers the header fields, whether or not the header is written
+	reader, err := aes.NewReaderWithOptions(bytes.NewReader(buf.Bytes()[len(writer.Header()):]), Config{Mode: ModeGCM, Salt: writer.Salt()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.mode = ModeGCMSIV
+	if _, err := io.ReadAll(reader); err != ErrAuthentication {
+		t.Error("Expected authentication error for a different header, got", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := bytes.Repeat([]byte("This is a secret message"), 500)
+
+	configs := []Config{
+		{Mode: ModeCTR, KeySize: KeySize192, KDF: &ScryptKDF{N: 1024, R: 8, P: 1}, MAC: sha256.New},
+		{Mode: ModeCBC, NoSalt: true},
+		{Mode: ModeGCM, KeySize: KeySize128, SaltSize: 32, ChunkSize: 1000},
+		{Mode: ModeOFB, Header: true, MAC: sha512.New},
+	}
+
+	for i, config := range configs {
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriterWithOptions(buf, config)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		writer.Write(message)
+		writer.Close()
+
+		config.IV = writer.IV()
+		config.Salt = writer.Salt()
+		reader, err := aes.NewReaderWithOptions(buf, config)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(i, err)
+		}
+		if !bytes.Equal(out, message) {
+			t.Error(i, "Decrypted plaintext does not equal original plaintext")
+		}
+	}
+
+	if _, err := aes.NewWriterWithOptions(bytes.NewBuffer(nil), Config{}); err != ErrUnknownCipherType {
+		t.Error("Expected unknown cipher type, got", err)
+	}
+	if _, err := aes.NewWriterWithOptions(bytes.NewBuffer(nil), Config{Mode: ModeGCM, ChunkSize: -1}); err != ErrInvalidChunkSize {
+		t.Error("Expected invalid chunk size, got", err)
+	}
+	if _, err := aes.NewReaderWithOptions(bytes.NewBuffer(nil), Config{Mode: ModeCFB}); err != ErrInvalidIVSize {
+		t.Error("Expected invalid IV size, got", err)
+	}
+}
+
 func TestAES128CFBWriter(t *testing.T) {
 	aes := NewAES([]byte("this is a secret"))
 
-	buf := bytes.NewBuffer(nil)
-	writer, _, err := aes.New128CFBWriter(buf)
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New128CFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAES128CFBReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New128CFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New128CFBReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+}
+
+func TestAES256CFBWriter(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256CFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAES256CFBReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256CFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New256CFBReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+}
+
+func TestAES128CTRReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New128CTRWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New128CTRReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+}
+
+func TestAES256CTRReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256CTRWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New256CTRReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+}
+
+func TestAES128OFBReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New128OFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New128OFBReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+}
+
+func TestAES256OFBReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256OFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := []byte("This is a secret message")
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New256OFBReader(buf, writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext", out)
+	}
+
+}
+
+func TestAES192AndGCM128(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+	message := bytes.Repeat([]byte("This is a secret message"), 500)
+
+	type pair struct {
+		keySize   int
+		newWriter func(io.Writer) (*AESWriter, error)
+		newReader func(io.Reader, []byte, []byte) (*AESReader, error)
+	}
+	withoutIV := func(newReader func(io.Reader, []byte) (*AESReader, error)) func(io.Reader, []byte, []byte) (*AESReader, error) {
+		return func(r io.Reader, iv []byte, salt []byte) (*AESReader, error) {
+			return newReader(r, salt)
+		}
+	}
+
+	pairs := []pair{
+		{KeySize192, aes.New192CBCWriter, aes.New192CBCReader},
+		{KeySize192, aes.New192CFBWriter, aes.New192CFBReader},
+		{KeySize192, aes.New192CTRWriter, aes.New192CTRReader},
+		{KeySize192, aes.New192OFBWriter, aes.New192OFBReader},
+		{KeySize192, aes.New192GCMWriter, withoutIV(aes.New192GCMReader)},
+		{KeySize128, aes.New128GCMWriter, withoutIV(aes.New128GCMReader)},
+		{KeySize128, aes.New128GCMSIVWriter, withoutIV(aes.New128GCMSIVReader)},
+	}
+
+	for i, p := range pairs {
+		buf := bytes.NewBuffer(nil)
+		writer, err := p.newWriter(buf)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if len(writer.key) != p.keySize {
+			t.Error(i, "Wrong key size", len(writer.key))
+		}
+		writer.Write(message)
+		writer.Close()
+
+		reader, err := p.newReader(buf, writer.IV(), writer.Salt())
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(i, err)
+		}
+		if !bytes.Equal(out, message) {
+			t.Error(i, "Decrypted plaintext does not equal original plaintext")
+		}
+	}
+}
+
+func TestAES256GCMReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256GCMWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	message := bytes.Repeat([]byte("This is a secret message"), defaultChunkSize/8)[:defaultChunkSize*3]
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New256GCMReader(buf, writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext")
+	}
+}
+
+func TestAES256GCMReaderTampered(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256GCMWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = writer.Write(make([]byte, defaultChunkSize*2))
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	cipherText := buf.Bytes()
+	cipherText[len(cipherText)-1] ^= 0x01
+
+	reader, err := aes.New256GCMReader(bytes.NewReader(cipherText), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+func TestAES256GCMCustomChunkSize(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256GCMWriterCustom(buf, 4096, KeySize256, sha512.New, DefaultSaltSize, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	message := bytes.Repeat([]byte("A"), 1000)
+
+	_, err = writer.Write(message)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	//Identical plaintext chunks must not produce identical ciphertext chunks
+	frameSize := chunkLengthSize + 100 + writer.aead.Overhead()
+	body := buf.Bytes()[chunkedHeaderSize(writer.aead.NonceSize()):]
+	if bytes.Equal(body[:frameSize], body[frameSize:frameSize*2]) {
+		t.Error("Chunks were sealed with the same nonce")
+	}
+
+	//The chunk size is read from the stream header
+	reader, err := aes.New256GCMReader(buf, writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext")
+	}
+}
+
+func TestAES256GCMTruncatedAndExtended(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256GCMWriterCustom(buf, 4096, KeySize256, sha512.New, DefaultSaltSize, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = writer.Write(make([]byte, 250))
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	cipherText := buf.Bytes()
+	frameSize := chunkLengthSize + 100 + writer.aead.Overhead()
+	headerSize := chunkedHeaderSize(writer.aead.NonceSize())
+
+	//Cut off after the second full chunk
+	reader, err := aes.New256GCMReader(bytes.NewReader(cipherText[:headerSize+frameSize*2]), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = io.ReadAll(reader)
+	if err != ErrTruncated {
+		t.Error("Expected truncation error, got", err)
+	}
+
+	//Append the first chunk after the final chunk
+	extended := append(append([]byte{}, cipherText...), cipherText[headerSize:headerSize+frameSize]...)
+	reader, err = aes.New256GCMReader(bytes.NewReader(extended), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+// Test vectors from RFC 8452 Appendix A and C
+func TestGCMSIVVectors(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	p := newPolyval(decode("25629347589242761d31f826ba4b757b"))
+	p.update(decode("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362"))
+	if sum := p.sum(); !bytes.Equal(sum[:], decode("f7a3b47b846119fae5b7866cf5e5b77e")) {
+		t.Error("POLYVAL mismatch", hex.EncodeToString(sum[:]))
+	}
+
+	//RFC 8452 Appendix C
+	vectors := []struct {
+		key, nonce, additionalData, plainText, result string
+	}{
+		{"01000000000000000000000000000000", "030000000000000000000000", "", "", "dc20e2d83f25705bb49e439eca56de25"},
+		{"01000000000000000000000000000000", "030000000000000000000000", "", "0100000000000000", "b5d839330ac7b786578782fff6013b815b287c22493a364c"},
+		{"01000000000000000000000000000000", "030000000000000000000000", "", "010000000000000000000000", "7323ea61d05932260047d942a4978db357391a0bc4fdec8b0d106639"},
+		{"01000000000000000000000000000000", "030000000000000000000000", "", "0100000000000000000000000000000002000000000000000000000000000000", "84e07e62ba83a6585417245d7ec413a9fe427d6315c09b57ce45f2e3936a94451a8e45dcd4578c667cd86847bf6155ff"},
+		{"01000000000000000000000000000000", "030000000000000000000000", "01", "0200000000000000", "1e6daba35669f4273b0a1a2560969cdf790d99759abd1508"},
+		{"01000000000000000000000000000000", "030000000000000000000000", "01", "0200000000000000000000000000000003000000000000000000000000000000", "620048ef3c1e73e57e02bb8562c416a319e73e4caac8e96a1ecb2933145a1d71e6af6a7f87287da059a71684ed3498e1"},
+		{"01000000000000000000000000000000", "030000000000000000000000", "010000000000000000000000", "02000000", "a8fe3e8707eb1f84fb28f8cb73de8e99e2f48a14"},
+		{"ee8e1ed9ff2540ae8f2ba9f50bc2f27c", "752abad3e0afb5f434dc4310", "6578616d706c65", "48656c6c6f20776f726c64", "5d349ead175ef6b1def6fd4fbcdeb7e4793f4a1d7e4faa70100af1"},
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "", "0100000000000000", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "", "01000000000000000000000000000000", "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366"},
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "01", "0200000000000000", "1de22967237a813291213f267e3b452f02d01ae33e4ec854"},
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "010000000000000000000000", "02000000", "22b3f4cd1835e517741dfddccfa07fa4661b74cf"},
+	}
+
+	for i, v := range vectors {
+		aead, err := newGCMSIV(decode(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sealed := aead.Seal(nil, decode(v.nonce), decode(v.plainText), decode(v.additionalData))
+		if !bytes.Equal(sealed, decode(v.result)) {
+			t.Error(i, "Seal mismatch", hex.EncodeToString(sealed))
+		}
+
+		opened, err := aead.Open(nil, decode(v.nonce), sealed, decode(v.additionalData))
+		if err != nil || !bytes.Equal(opened, decode(v.plainText)) {
+			t.Error(i, "Open failed", err)
+		}
+
+		if _, err := aead.Open(nil, decode(v.nonce), sealed, []byte("other")); err == nil {
+			t.Error(i, "Opened with different additional data")
+		}
+		sealed[0] ^= 0x01
+		if _, err := aead.Open(nil, decode(v.nonce), sealed, decode(v.additionalData)); err == nil {
+			t.Error(i, "Opened a tampered ciphertext")
+		}
+	}
+
+	if _, err := newGCMSIV(make([]byte, KeySize192)); err != ErrInvalidKeySize {
+		t.Error("Expected invalid key size, got", err)
+	}
+}
+
+func TestAES256GCMSIVReader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.New256GCMSIVWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := bytes.Repeat([]byte("This is a secret message"), defaultChunkSize/8)
+
+	writer.Write(message)
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := aes.New256GCMSIVReader(buf, writer.Salt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext")
+	}
+}
+
+func TestXChaCha20Poly1305Reader(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	buf := bytes.NewBuffer(nil)
+	writer, err := aes.NewXChaCha20Poly1305Writer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := bytes.Repeat([]byte("This is a secret message"), defaultChunkSize/8)
+
+	writer.Write(message)
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if writer.aead.NonceSize() != 24 {
+		t.Error("Not using extended nonces")
+	}
+
+	cipherText := buf.Bytes()
+
+	reader, err := aes.NewXChaCha20Poly1305Reader(bytes.NewReader(cipherText), writer.Salt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(reader)
 	if err != nil {
 		t.Error(err)
 	}
-	message := []byte("This is a secret message")
+	if !bytes.Equal(out, message) {
+		t.Error("Decrypted plaintext does not equal original plaintext")
+	}
 
-	_, err = writer.Write(message)
+	cipherText[len(cipherText)/2] ^= 0x01
+	reader, err = aes.NewXChaCha20Poly1305Reader(bytes.NewReader(cipherText), writer.Salt())
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(reader); err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
 	}
 
-	err = writer.Close()
+	if _, err = aes.NewWriterWithOptions(buf, Config{Mode: ModeXChaCha20Poly1305, KeySize: KeySize128}); err != ErrInvalidKeySize {
+		t.Error("Expected invalid key size, got", err)
+	}
+}
+
+func TestSIV(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	//RFC 4493 CMAC examples
+	block, err := aes.NewCipher(decode("2b7e151628aed2a6abf7158809cf4f3c"))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if mac := cmac(block, nil); !bytes.Equal(mac[:], decode("bb1d6929e95937287fa37d129b756746")) {
+		t.Error("CMAC mismatch for empty message", hex.EncodeToString(mac[:]))
+	}
+	if mac := cmac(block, decode("6bc1bee22e409f96e93d7e117393172a")); !bytes.Equal(mac[:], decode("070a16b46b4d4144f79bdd9dd04a287c")) {
+		t.Error("CMAC mismatch for one block", hex.EncodeToString(mac[:]))
+	}
+
+	//RFC 5297 A.1 deterministic authenticated encryption example
+	siv, err := NewAESFromKey(decode("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	additionalData := decode("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plainText := decode("112233445566778899aabbccddee")
+
+	sealed, err := siv.SealSIV(plainText, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sealed, decode("85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")) {
+		t.Error("SIV mismatch", hex.EncodeToString(sealed))
+	}
+
+	opened, err := siv.OpenSIV(sealed, additionalData)
+	if err != nil || !bytes.Equal(opened, plainText) {
+		t.Error("Open failed", err)
+	}
+	if _, err := siv.OpenSIV(sealed, []byte("other additional data")); err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+
+	//Password keys are deterministic across instances
+	first, err := NewAES([]byte("this is a secret")).SealSIV([]byte("config secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewAES([]byte("this is a secret")).SealSIV([]byte("config secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("SIV is not deterministic")
+	}
+	opened, err = NewAES([]byte("this is a secret")).OpenSIV(first)
+	if err != nil || string(opened) != "config secret" {
+		t.Error("Open failed", err)
+	}
+
+	short, err := NewAESFromKey(make([]byte, KeySize128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := short.SealSIV(plainText); err != ErrInvalidKeySize {
+		t.Error("Expected invalid key size, got", err)
 	}
 }
 
-func TestAES128CFBReader(t *testing.T) {
+func TestKeyWrap(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	//RFC 3394 4.1
+	kek, err := NewAESFromKey(decode("000102030405060708090a0b0c0d0e0f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := decode("00112233445566778899aabbccddeeff")
+
+	wrapped, err := kek.WrapKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wrapped, decode("1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5")) {
+		t.Error("Wrap mismatch", hex.EncodeToString(wrapped))
+	}
+	unwrapped, err := kek.UnwrapKey(wrapped)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Error("Unwrap failed", err)
+	}
+
+	wrapped[0] ^= 0x01
+	if _, err := kek.UnwrapKey(wrapped); err != ErrKeyUnwrap {
+		t.Error("Expected integrity error, got", err)
+	}
+
+	//RFC 5649 6
+	kek, err = NewAESFromKey(decode("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := []struct {
+		key, wrapped string
+	}{
+		{"c37b7e6492584340bed12207808941155068f738", "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	}
+	for i, v := range vectors {
+		wrapped, err := kek.WrapKeyWithPadding(decode(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wrapped, decode(v.wrapped)) {
+			t.Error(i, "Padded wrap mismatch", hex.EncodeToString(wrapped))
+		}
+		unwrapped, err := kek.UnwrapKeyWithPadding(wrapped)
+		if err != nil || !bytes.Equal(unwrapped, decode(v.key)) {
+			t.Error(i, "Padded unwrap failed", err)
+		}
+
+		wrapped[len(wrapped)-1] ^= 0x01
+		if _, err := kek.UnwrapKeyWithPadding(wrapped); err != ErrKeyUnwrap {
+			t.Error(i, "Expected integrity error, got", err)
+		}
+	}
+
+	//Password derived key encryption keys
+	wrapped, err = NewAES([]byte("this is a secret")).WrapKeyWithPadding(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err = NewAES([]byte("this is a secret")).UnwrapKeyWithPadding(wrapped)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Error("Unwrap with password failed", err)
+	}
+	if _, err := NewAES([]byte("wrong secret")).UnwrapKeyWithPadding(wrapped); err != ErrKeyUnwrap {
+		t.Error("Expected integrity error, got", err)
+	}
+
+	//A length beyond the padded key, in the single block case, must not panic
+	block, err := kek.keyWrapCipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []uint32{0, 9, 0x80000000, 0xffffffff} {
+		forged := make([]byte, AESBlockSize)
+		copy(forged, keyWrapPaddedIV)
+		binary.BigEndian.PutUint32(forged[4:], length)
+		block.Encrypt(forged, forged)
+		if _, err := kek.UnwrapKeyWithPadding(forged); err != ErrKeyUnwrap {
+			t.Error(length, "Expected integrity error, got", err)
+		}
+	}
+
+	if _, err := kek.WrapKey(make([]byte, 12)); err != ErrInvalidWrapInput {
+		t.Error("Expected invalid input, got", err)
+	}
+}
+
+func TestAES256CBCMAC(t *testing.T) {
 	aes := NewAES([]byte("this is a secret"))
 
 	buf := bytes.NewBuffer(nil)
-	writer, iv, err := aes.New128CFBWriter(buf)
+	writer, err := aes.NewWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.EnableMAC(sha256.New)
 	if err != nil {
 		t.Error(err)
 	}
@@ -132,8 +2265,17 @@ func TestAES128CFBReader(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	if buf.Len() != 32+sha256.Size {
+		t.Error("Tag not appended", buf.Len())
+	}
 
-	reader, err := aes.New128CFBReader(buf, iv)
+	cipherText := buf.Bytes()
+
+	reader, err := aes.NewReader(bytes.NewReader(cipherText), writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	err = reader.EnableMAC(sha256.New)
 	if err != nil {
 		t.Error(err)
 	}
@@ -145,34 +2287,50 @@ func TestAES128CFBReader(t *testing.T) {
 		t.Error("Decrypted plaintext does not equal original plaintext", out)
 	}
 
-}
-
-func TestAES256CFBWriter(t *testing.T) {
-	aes := NewAES([]byte("this is a secret"))
+	//Flip a bit in the padding block, which must be caught before unpadding
+	tampered := append([]byte{}, cipherText...)
+	tampered[16] ^= 0x01
 
-	buf := bytes.NewBuffer(nil)
-	writer, _, err := aes.New256CFBWriter(buf)
+	reader, err = aes.NewReader(bytes.NewReader(tampered), writer.IV(), writer.Salt())
 	if err != nil {
 		t.Error(err)
 	}
-	message := []byte("This is a secret message")
-
-	_, err = writer.Write(message)
+	err = reader.EnableMAC(sha256.New)
 	if err != nil {
 		t.Error(err)
 	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
 
-	err = writer.Close()
+	//The IV is covered by the tag too
+	tamperedIV := append([]byte{}, writer.IV()...)
+	tamperedIV[0] ^= 0x01
+
+	reader, err = aes.NewReader(bytes.NewReader(cipherText), tamperedIV, writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	err = reader.EnableMAC(sha256.New)
 	if err != nil {
 		t.Error(err)
 	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
 }
 
-func TestAES256CFBReader(t *testing.T) {
+func TestAES128CFBMAC(t *testing.T) {
 	aes := NewAES([]byte("this is a secret"))
 
 	buf := bytes.NewBuffer(nil)
-	writer, iv, err := aes.New256CFBWriter(buf)
+	writer, err := aes.New128CFBWriter(buf)
+	if err != nil {
+		t.Error(err)
+	}
+	err = writer.EnableMAC(sha512.New)
 	if err != nil {
 		t.Error(err)
 	}
@@ -187,7 +2345,13 @@ func TestAES256CFBReader(t *testing.T) {
 		t.Error(err)
 	}
 
-	reader, err := aes.New256CFBReader(buf, iv)
+	cipherText := buf.Bytes()
+
+	reader, err := aes.New128CFBReader(bytes.NewReader(cipherText), writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	err = reader.EnableMAC(sha512.New)
 	if err != nil {
 		t.Error(err)
 	}
@@ -199,6 +2363,40 @@ func TestAES256CFBReader(t *testing.T) {
 		t.Error("Decrypted plaintext does not equal original plaintext", out)
 	}
 
+	cipherText[len(cipherText)-1] ^= 0x01
+	reader, err = aes.New128CFBReader(bytes.NewReader(cipherText), writer.IV(), writer.Salt())
+	if err != nil {
+		t.Error(err)
+	}
+	err = reader.EnableMAC(sha512.New)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = io.ReadAll(reader)
+	if err != ErrAuthentication {
+		t.Error("Expected authentication error, got", err)
+	}
+}
+
+func TestMACUnsupported(t *testing.T) {
+	aes := NewAES([]byte("this is a secret"))
+
+	writer, err := aes.New256GCMWriter(bytes.NewBuffer(nil))
+	if err != nil {
+		t.Error(err)
+	}
+	if writer.EnableMAC(sha256.New) != ErrMACUnsupported {
+		t.Error("GCM writer accepted a MAC")
+	}
+
+	writer, err = aes.NewWriter(bytes.NewBuffer(nil))
+	if err != nil {
+		t.Error(err)
+	}
+	writer.Write([]byte("data"))
+	if writer.EnableMAC(sha256.New) != ErrStreamStarted {
+		t.Error("MAC enabled after the first write")
+	}
 }
 
 // Fuzz CFB
@@ -208,7 +2406,7 @@ func FuzzAESCFB128(f *testing.F) {
 		aes := NewAES(secret)
 
 		buf := bytes.NewBuffer(nil)
-		writer, iv, err := aes.New128CFBWriter(buf)
+		writer, err := aes.New128CFBWriter(buf)
 		if err != nil {
 			t.Error(err)
 		}
@@ -221,7 +2419,7 @@ func FuzzAESCFB128(f *testing.F) {
 			t.Error(err)
 		}
 
-		reader, err := aes.New128CFBReader(buf, iv)
+		reader, err := aes.New128CFBReader(buf, writer.IV(), writer.Salt())
 		if err != nil {
 			t.Error(err)
 		}
@@ -241,7 +2439,106 @@ func FuzzAESCFB256(f *testing.F) {
 		aes := NewAES(secret)
 
 		buf := bytes.NewBuffer(nil)
-		writer, iv, err := aes.New256CFBWriter(buf)
+		writer, err := aes.New256CFBWriter(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			t.Error(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		reader, err := aes.New256CFBReader(buf, writer.IV(), writer.Salt())
+		if err != nil {
+			t.Error(err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Error("Decrypted plaintext does not equal original plaintext", out)
+		}
+	})
+}
+
+func FuzzAESCTR256(f *testing.F) {
+	f.Add([]byte("password"), []byte("data to encrypt"))
+	f.Fuzz(func(t *testing.T, secret []byte, data []byte) {
+		aes := NewAES(secret)
+
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.New256CTRWriter(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			t.Error(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		reader, err := aes.New256CTRReader(buf, writer.IV(), writer.Salt())
+		if err != nil {
+			t.Error(err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Error("Decrypted plaintext does not equal original plaintext", out)
+		}
+	})
+}
+
+func FuzzAESOFB256(f *testing.F) {
+	f.Add([]byte("password"), []byte("data to encrypt"))
+	f.Fuzz(func(t *testing.T, secret []byte, data []byte) {
+		aes := NewAES(secret)
+
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.New256OFBWriter(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			t.Error(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		reader, err := aes.New256OFBReader(buf, writer.IV(), writer.Salt())
+		if err != nil {
+			t.Error(err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Error("Decrypted plaintext does not equal original plaintext", out)
+		}
+	})
+}
+
+func FuzzAESGCM256(f *testing.F) {
+	f.Add([]byte("password"), []byte("data to encrypt"))
+	f.Fuzz(func(t *testing.T, secret []byte, data []byte) {
+		aes := NewAES(secret)
+
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.New256GCMWriterCustom(buf, 4096, KeySize256, sha512.New, DefaultSaltSize, 16)
 		if err != nil {
 			t.Error(err)
 		}
@@ -254,7 +2551,7 @@ func FuzzAESCFB256(f *testing.F) {
 			t.Error(err)
 		}
 
-		reader, err := aes.New256CFBReader(buf, iv)
+		reader, err := aes.New256GCMReader(buf, writer.Salt())
 		if err != nil {
 			t.Error(err)
 		}
@@ -268,6 +2565,48 @@ func FuzzAESCFB256(f *testing.F) {
 	})
 }
 
+func FuzzAESCBCMAC(f *testing.F) {
+	f.Add([]byte("password"), []byte("data to encrypt"), 10)
+	f.Fuzz(func(t *testing.T, secret []byte, data []byte, readSize int) {
+
+		if readSize <= 0 || readSize > 1<<16 {
+			t.Skip()
+		}
+
+		aes := NewAES(secret)
+
+		buf := bytes.NewBuffer(nil)
+		writer, err := aes.NewWriter(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		err = writer.EnableMAC(sha256.New)
+		if err != nil {
+			t.Error(err)
+		}
+		writer.Write(data)
+		writer.Close()
+
+		reader, err := aes.NewReader(buf, writer.IV(), writer.Salt())
+		if err != nil {
+			t.Error(err)
+		}
+		err = reader.EnableMAC(sha256.New)
+		if err != nil {
+			t.Error(err)
+		}
+
+		out := bytes.NewBuffer(nil)
+		_, err = io.CopyBuffer(out, reader, make([]byte, readSize))
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Error("Input and output not the same!")
+		}
+	})
+}
+
 // Fuzz the contents, lengths and keys
 func FuzzAESDefaultsInputs(f *testing.F) {
 
@@ -276,14 +2615,14 @@ func FuzzAESDefaultsInputs(f *testing.F) {
 		aes := NewAES(secret)
 
 		buf := bytes.NewBuffer(nil)
-		writer, iv, err := aes.NewWriter(buf)
+		writer, err := aes.NewWriter(buf)
 		if err != nil {
 			t.Error(err)
 		}
 		writer.Write(data)
 		writer.Close()
 
-		reader, err := aes.NewReader(buf, iv)
+		reader, err := aes.NewReader(buf, writer.IV(), writer.Salt())
 		if err != nil {
 			t.Error(err)
 		}
@@ -312,7 +2651,7 @@ func FuzzAESDefaultsBuffers(f *testing.F) {
 		aes := NewAES(secret)
 
 		buf := bytes.NewBuffer(nil)
-		writer, iv, err := aes.NewWriter(buf)
+		writer, err := aes.NewWriter(buf)
 		if err != nil {
 			t.Error(err)
 		}
@@ -324,7 +2663,7 @@ func FuzzAESDefaultsBuffers(f *testing.F) {
 
 		writer.Close()
 
-		reader, err := aes.NewReader(buf, iv)
+		reader, err := aes.NewReader(buf, writer.IV(), writer.Salt())
 		if err != nil {
 			t.Error(err)
 		}
@@ -3,8 +3,11 @@ package gocrypt
 import (
 	"bytes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"hash"
 	"io"
 )
 
@@ -13,7 +16,9 @@ var ErrUnknownCipherType error = errors.New("incorrect cipher type")
 type AESWriter struct {
 	BlockSize int
 	key       []byte
-	IV        []byte
+	iv        []byte
+	salt      []byte
+	kdf       KDF
 
 	downstream io.Writer //The writer that Write() will subsequently write cipher text to.
 
@@ -28,16 +33,49 @@ type AESWriter struct {
 
 	stream cipher.Stream
 
-	aead      cipher.AEAD
-	chunkSize int
+	aead          cipher.AEAD
+	chunkSize     int
+	baseNonce     []byte
+	counter       uint64
+	headerWritten bool
+	chunkData     chunkData
+
+	mac     *macWriter
+	started bool
+
+	mode                   Mode
+	containerHeader        bool
+	containerHeaderWritten bool
+
+	wrappedKey []byte
+
+	workers int
+	pending []*sealJob
+
+	//Reused between chunks, see scratchBuffer
+	nonce   []byte
+	scratch []byte
 }
 
 /*
 * Close() Closes the AES stream, and flushes any remaining data to the downstream writer.
 * Applies PKCS#7 padding to the remaining data, if required
+* Authenticated streams seal the remaining data as the final chunk.
+* If a MAC is enabled, the tag is appended last.
  */
 func (aw *AESWriter) Close() error {
 
+	if aw.closed {
+		return nil
+	}
+
+	if aw.containerHeader && !aw.containerHeaderWritten {
+		err := aw.writeContainerHeader()
+		if err != nil {
+			return err
+		}
+	}
+
 	defer func() {
 		aw.closed = true
 	}()
@@ -66,6 +104,25 @@ func (aw *AESWriter) Close() error {
 				return err
 			}
 		}
+
+	case authenticatedCipherType:
+		_, err := aw.Flush()
+		if err != nil {
+			return err
+		}
+
+		//Whatever is left is sealed as the final chunk, even if empty, so truncation can be detected
+		_, err = aw.writeChunk(aw.buffer.Next(aw.buffer.Len()), true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if aw.mac != nil {
+		_, err := aw.mac.writeTag()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -80,43 +137,51 @@ func (aw *AESWriter) Flush() (written int, err error) {
 
 	switch aw.cipherType {
 	case blockCipherType:
-		dst := make([]byte, AESBlockSize)
-		for aw.buffer.Len() >= AESBlockSize {
-			aw.blockMode.CryptBlocks(dst, aw.buffer.Next(AESBlockSize))
-			written, err = aw.downstream.Write(dst)
+		toWrite := aw.buffer.Len() / AESBlockSize * AESBlockSize
+		if toWrite == 0 {
+			return 0, nil
+		}
+
+		//Encrypted in place, the buffer is done with these bytes
+		blocks := aw.buffer.Next(toWrite)
+		aw.blockMode.CryptBlocks(blocks, blocks)
+		return aw.downstream.Write(blocks)
+
+	case authenticatedCipherType:
+		if aw.workers > 1 {
+			written, err = aw.queueChunks()
 			if err != nil {
 				return written, err
 			}
+			return aw.writePending(-1)
 		}
 
-		return written, err
-
-	//TODO this should be taking as large as blocks as possible
-	//Because you can never re-use a nonce for a seal with the same KEY, limiting the total size.
-	//This should be adjustable with sane defaults, and a protection against re-use
-	case authenticatedCipherType:
-		nonce := make([]byte, aw.aead.NonceSize())
-		rand.Read(nonce)
+		if !aw.headerWritten {
+			written, err = aw.writeChunkedHeader()
+			if err != nil {
+				return written, err
+			}
+		}
 
 		for aw.buffer.Len() >= aw.chunkSize {
-			cipherText := aw.aead.Seal(nil, nonce, aw.buffer.Next(aw.chunkSize), nil)
-
-			written, err := aw.downstream.Write(cipherText)
+			written, err = aw.writeChunk(aw.buffer.Next(aw.chunkSize), false)
 			if err != nil {
 				return written, err
 			}
-
 		}
 		return written, err
 
 	case streamCipherType:
 
-		dst := make([]byte, aw.buffer.Len())
-		src, _ := io.ReadAll(&aw.buffer)
-		aw.stream.XORKeyStream(dst, src)
+		if aw.buffer.Len() == 0 {
+			return 0, nil
+		}
 
-		written, err := aw.downstream.Write(dst)
-		return written, err
+		//Encrypted in place, the buffer is done with these bytes
+		cipherText := aw.buffer.Next(aw.buffer.Len())
+		aw.stream.XORKeyStream(cipherText, cipherText)
+
+		return aw.downstream.Write(cipherText)
 
 	default:
 		return 0, ErrUnknownCipherType
@@ -124,21 +189,115 @@ func (aw *AESWriter) Flush() (written int, err error) {
 }
 
 /*
-* Write() writes any number of bytes to an internal buffer, and flushes as many as possible
-* to the downstream writer. Returning the number of bytes written downstream, or an error.
-* If the internal buffer fails to write, the number of bytes returned is the number of bytes written into the internal buffer.
+* writeChunkedHeader() picks a random base nonce and writes the chunked stream header to the downstream writer.
+ */
+func (aw *AESWriter) writeChunkedHeader() (int, error) {
+	aw.baseNonce = make([]byte, aw.aead.NonceSize())
+	_, err := rand.Read(aw.baseNonce)
+	if err != nil {
+		return 0, err
+	}
+
+	h := aw.description()
+	aw.chunkData = newChunkData(h.authenticated())
+
+	aw.headerWritten = true
+	return aw.downstream.Write(marshalChunkedHeader(aw.chunkSize, aw.baseNonce))
+}
+
+/*
+* writeChunk() seals a single chunk with the next chunk nonce and writes it, length prefixed, to the downstream writer.
+* The final flag is part of both the length prefix and the associated data.
+ */
+func (aw *AESWriter) writeChunk(plainText []byte, final bool) (int, error) {
+	aw.nonce = scratchBuffer(aw.nonce, aw.aead.NonceSize())
+	chunkNonce(aw.nonce, aw.baseNonce, aw.counter)
+	aw.counter++
+
+	//The length prefix and ciphertext are written together
+	frame := scratchBuffer(aw.scratch, chunkLengthSize+len(plainText)+aw.aead.Overhead())[:chunkLengthSize]
+	frame = aw.aead.Seal(frame, aw.nonce, plainText, aw.chunkData.additionalData(final))
+	aw.scratch = frame
+	binary.BigEndian.PutUint32(frame, marshalChunkLength(len(frame)-chunkLengthSize, final))
+
+	return aw.downstream.Write(frame)
+}
+
+/*
+* Write() writes any number of bytes to an internal buffer, and flushes as many as possible to the downstream writer.
+* Returns len(plaintext) once it is buffered, as io.Writer expects, or 0 and the error of the downstream writer.
+* Incomplete blocks and chunks stay buffered until a later Write, Flush or Close.
  */
 func (aw *AESWriter) Write(plaintext []byte) (n int, err error) {
 
 	if aw.closed {
 		return 0, io.ErrClosedPipe
 	}
+	aw.started = true
+
+	if aw.containerHeader && !aw.containerHeaderWritten {
+		err = aw.writeContainerHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	written, err := aw.buffer.Write(plaintext)
 	if err != nil {
 		return written, err
 	}
-	written, err = aw.Flush()
+	//Parallel chunks are only waited for once the queue is full, Flush and Close wait for all of them
+	if aw.cipherType == authenticatedCipherType && aw.workers > 1 {
+		_, err = aw.queueChunks()
+	} else {
+		_, err = aw.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(plaintext), nil
+}
+
+/*
+* EnableMAC() authenticates the ciphertext with HMAC (encrypt-then-MAC), hashFunction is meant to be sha256.New or sha512.New.
+* The MAC key is derived separately from the encryption key, and the tag over IV and ciphertext is appended on Close.
+* Must be called before the first Write. Only CBC and CFB writers support it, GCM is already authenticated.
+ */
+func (aw *AESWriter) EnableMAC(hashFunction func() hash.Hash) error {
+	if aw.cipherType == authenticatedCipherType {
+		return ErrMACUnsupported
+	}
+	if aw.started || aw.mac != nil {
+		return ErrStreamStarted
+	}
+
+	aw.mac = &macWriter{
+		downstream:   aw.downstream,
+		hashFunction: hashFunction,
+		mac:          hmac.New(hashFunction, deriveMACKey(aw.key, hashFunction, aw.mode)),
+	}
+	h := aw.description()
+	aw.mac.mac.Write(h.authenticated())
+	aw.downstream = aw.mac
+
+	return nil
+}
+
+// IV returns the IV the stream is encrypted with, GCM streams have none as their nonces are part of the stream
+func (aw *AESWriter) IV() []byte {
+	if aw.cipherType == authenticatedCipherType {
+		return nil
+	}
+	return aw.iv
+}
+
+// Salt returns the random salt the key was derived with, needed to read the stream back
+func (aw *AESWriter) Salt() []byte {
+	return aw.salt
+}
 
-	return written, err
+// KDF returns the key derivation function the key was derived with, see ParseKDF
+func (aw *AESWriter) KDF() KDF {
+	return aw.kdf
 }
@@ -0,0 +1,127 @@
+/*
+gocrypt is a command line tool for streams written by the gocrypt package.
+
+	gocrypt rekey -in <file> -out <file> [-old-password-file <file>] [-new-password-file <file>] [-old-key-file <file>] [-new-key-file <file>]
+
+rekey moves an envelope stream to a new password or raw key by rewriting its header, without re-encrypting the body.
+Passwords are read from the given files, or from the GOCRYPT_PASSWORD and GOCRYPT_NEW_PASSWORD environment variables.
+Key files hold a raw 16, 24 or 32 byte key.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Foosec/gocrypt"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "rekey":
+		err = rekey(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gocrypt:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gocrypt rekey -in <file> -out <file> [flags]")
+	os.Exit(2)
+}
+
+func rekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	in := flags.String("in", "", "envelope stream to rekey")
+	out := flags.String("out", "", "where to write the rekeyed stream, must not be the input")
+	oldPasswordFile := flags.String("old-password-file", "", "file holding the current password, defaults to $GOCRYPT_PASSWORD")
+	newPasswordFile := flags.String("new-password-file", "", "file holding the new password, defaults to $GOCRYPT_NEW_PASSWORD")
+	oldKeyFile := flags.String("old-key-file", "", "file holding the current raw key, instead of a password")
+	newKeyFile := flags.String("new-key-file", "", "file holding the new raw key, instead of a password")
+	flags.Parse(args)
+
+	if *in == "" || *out == "" {
+		return errors.New("-in and -out are required")
+	}
+	if *in == *out {
+		return errors.New("-out must not be the input file")
+	}
+
+	oldAES, err := loadAES(*oldKeyFile, *oldPasswordFile, "GOCRYPT_PASSWORD")
+	if err != nil {
+		return err
+	}
+	newAES, err := loadAES(*newKeyFile, *newPasswordFile, "GOCRYPT_NEW_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	//Written to a temporary file first, so a wrong key never leaves a partial output behind
+	tmp := *out + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = oldAES.Rekey(src, dst, newAES)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, *out)
+}
+
+/* loadAES creates an AES from a raw key file, a password file, or the password in the environment variable, in that order.
+*  Returns AES, error
+ */
+func loadAES(keyFile string, passwordFile string, env string) (*gocrypt.AES, error) {
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return gocrypt.NewAESFromKey(key)
+	}
+
+	if passwordFile != "" {
+		password, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		return gocrypt.NewAES(bytes.TrimRight(password, "\r\n")), nil
+	}
+
+	password := os.Getenv(env)
+	if password == "" {
+		return nil, fmt.Errorf("no password given, set %s or use a password or key file", env)
+	}
+	return gocrypt.NewAES([]byte(password)), nil
+}
@@ -2,4 +2,4 @@ module github.com/Foosec/gocrypt
 
 go 1.16
 
-require golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3 // indirect
+require golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
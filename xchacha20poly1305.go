@@ -0,0 +1,45 @@
+/*
+XChaCha20-Poly1305 streams use the same chunked framing as GCM, described in aes_chunked.go,
+with 24 byte nonces. The key is derived just like an AES-256 key.
+*/
+
+package gocrypt
+
+import (
+	"crypto/sha512"
+	"hash"
+	"io"
+)
+
+func (a *AES) NewXChaCha20Poly1305WriterCustom(downstream io.Writer, keyIterations int, hashFunction func() hash.Hash, saltSize int, chunkSize int) (*AESWriter, error) {
+	return a.NewWriterWithOptions(downstream, Config{
+		Mode:      ModeXChaCha20Poly1305,
+		KeySize:   KeySize256,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		SaltSize:  saltSize,
+		NoSalt:    saltSize == 0,
+		ChunkSize: chunkSize,
+	})
+}
+
+func (a *AES) NewXChaCha20Poly1305Writer(downstream io.Writer) (*AESWriter, error) {
+	return a.NewXChaCha20Poly1305WriterCustom(downstream, 4096, sha512.New, DefaultSaltSize, defaultChunkSize)
+}
+
+//Readers
+
+/* NewXChaCha20Poly1305ReaderCustom reads the chunk size from the stream header, chunkSize is the largest chunk size it will accept.
+ */
+func (a *AES) NewXChaCha20Poly1305ReaderCustom(upstream io.Reader, salt []byte, keyIterations int, hashFunction func() hash.Hash, chunkSize int) (*AESReader, error) {
+	return a.NewReaderWithOptions(upstream, Config{
+		Mode:      ModeXChaCha20Poly1305,
+		KeySize:   KeySize256,
+		KDF:       a.keyDerivation(keyIterations, hashFunction),
+		ChunkSize: chunkSize,
+		Salt:      salt,
+	})
+}
+
+func (a *AES) NewXChaCha20Poly1305Reader(upstream io.Reader, salt []byte) (*AESReader, error) {
+	return a.NewXChaCha20Poly1305ReaderCustom(upstream, salt, 4096, sha512.New, maxChunkSize)
+}